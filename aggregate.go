@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	. "hermes/core"
+	"net/http"
+	"strconv"
+)
+
+const (
+	maxHistogramBuckets    = 10000
+	defaultHistogramBucket = 100
+	minHistogramInterval   = 1000
+
+	defaultStatsTop = 10
+	maxStatsTop     = 1000
+)
+
+/**
+HistogramQuery counts the logs matching LogQuery per Interval milliseconds.
+When Interval is left out the time range is split into about a hundred
+buckets.
+*/
+type HistogramQuery struct {
+	LogQuery
+	Interval   int64  `json:"interval,omitempty"`
+	GroupBy    string `json:"group_by,omitempty"`
+	ContextKey string `json:"context_key,omitempty"`
+}
+
+func (q HistogramQuery) option() (opt HistogramOption, err error) {
+	opt.QueryLogOption, err = q.LogQuery.option(0, nil)
+	if err != nil {
+		return
+	}
+	span := q.End - q.Start
+	if span <= 0 {
+		err = errors.New("end of time range must be after its start")
+		return
+	}
+
+	opt.Interval = q.Interval
+	if opt.Interval == 0 {
+		opt.Interval = span / defaultHistogramBucket
+		if opt.Interval < minHistogramInterval {
+			opt.Interval = minHistogramInterval
+		}
+	}
+	if opt.Interval < 0 {
+		err = errors.New("interval must not be negative")
+		return
+	}
+	if span/opt.Interval > maxHistogramBuckets {
+		err = fmt.Errorf("time range is split into more than %d buckets", maxHistogramBuckets)
+		return
+	}
+
+	switch q.GroupBy {
+	case "", GroupByContainer:
+		break
+	case GroupByContext:
+		if StrIsEmpty(q.ContextKey) {
+			err = errors.New("missing context key to group by")
+			return
+		}
+		break
+	default:
+		err = fmt.Errorf("group by %s is not supported", q.GroupBy)
+		return
+	}
+	opt.GroupBy = q.GroupBy
+	opt.ContextKey = q.ContextKey
+	return
+}
+
+func histogram(ctx context.Context, q HistogramQuery) OutputHistogramMessage {
+	response := OutputHistogramMessage{
+		OutputMessage: OutputMessage{
+			Code:    http.StatusOK,
+			Message: "OK",
+		},
+	}
+	aggregator, ok := mainStorage.(LogAggregator)
+	if !ok {
+		response.Code = http.StatusNotImplemented
+		response.Message = "main storage can not aggregate logs"
+		return response
+	}
+	opt, err := q.option()
+	if err != nil {
+		response.Code = http.StatusBadRequest
+		response.Message = err.Error()
+		return response
+	}
+	response.Interval = opt.Interval
+	response.Data, err = aggregator.Histogram(ctx, opt)
+	if err != nil {
+		response.Code = http.StatusInternalServerError
+		response.Message = err.Error()
+	}
+	return response
+}
+
+func retrieveHistogram(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	query, err := parseLogQuery(r)
+	if err != nil {
+		writeJsonResponse(w, http.StatusBadRequest, OutputMessage{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		})
+		return
+	}
+	q := HistogramQuery{
+		LogQuery:   query,
+		GroupBy:    r.URL.Query().Get("group_by"),
+		ContextKey: r.URL.Query().Get("context_key"),
+	}
+	if v := r.URL.Query().Get("interval"); v != "" {
+		q.Interval, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeJsonResponse(w, http.StatusBadRequest, OutputMessage{
+				Code:    http.StatusBadRequest,
+				Message: "interval must be a number",
+			})
+			return
+		}
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer func() {
+		cancel()
+	}()
+	response := histogram(ctx, q)
+	writeJsonResponse(w, int(response.Code), response)
+}
+
+/**
+StatsQuery counts the logs matching LogQuery, the distinct values of Field and
+its Top most frequent values. Unlike other queries the tag may be left out to
+count across every tag.
+*/
+type StatsQuery struct {
+	LogQuery
+	Field      string `json:"field,omitempty"`
+	ContextKey string `json:"context_key,omitempty"`
+	Top        int32  `json:"top,omitempty"`
+}
+
+func (q StatsQuery) option() (opt StatsOption, err error) {
+	opt.QueryLogOption, err = q.LogQuery.filter(0, nil)
+	if err != nil {
+		return
+	}
+
+	switch q.Field {
+	case "":
+		opt.Field = FieldTag
+		break
+	case FieldTag, FieldContainer, FieldLevel, FieldMessage:
+		opt.Field = q.Field
+		break
+	case FieldContext:
+		if StrIsEmpty(q.ContextKey) {
+			err = errors.New("missing context key to count")
+			return
+		}
+		opt.Field = q.Field
+		opt.ContextKey = q.ContextKey
+		break
+	default:
+		err = fmt.Errorf("field %s is not supported", q.Field)
+		return
+	}
+
+	opt.Top = q.Top
+	if opt.Top == 0 {
+		opt.Top = defaultStatsTop
+	}
+	if opt.Top < 0 || opt.Top > maxStatsTop {
+		err = fmt.Errorf("top must be between 1 and %d", maxStatsTop)
+		return
+	}
+	return
+}
+
+func stats(ctx context.Context, q StatsQuery) OutputStatsMessage {
+	response := OutputStatsMessage{
+		OutputMessage: OutputMessage{
+			Code:    http.StatusOK,
+			Message: "OK",
+		},
+	}
+	aggregator, ok := mainStorage.(LogAggregator)
+	if !ok {
+		response.Code = http.StatusNotImplemented
+		response.Message = "main storage can not aggregate logs"
+		return response
+	}
+	opt, err := q.option()
+	if err != nil {
+		response.Code = http.StatusBadRequest
+		response.Message = err.Error()
+		return response
+	}
+	data, err := aggregator.Stats(ctx, opt)
+	if err != nil {
+		response.Code = http.StatusInternalServerError
+		response.Message = err.Error()
+		return response
+	}
+	response.Data = &data
+	return response
+}
+
+func retrieveStats(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	query, err := parseLogQuery(r)
+	if err != nil {
+		writeJsonResponse(w, http.StatusBadRequest, OutputMessage{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		})
+		return
+	}
+	q := StatsQuery{
+		LogQuery:   query,
+		Field:      r.URL.Query().Get("field"),
+		ContextKey: r.URL.Query().Get("context_key"),
+	}
+	if v := r.URL.Query().Get("top"); v != "" {
+		top, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			writeJsonResponse(w, http.StatusBadRequest, OutputMessage{
+				Code:    http.StatusBadRequest,
+				Message: "top must be a number",
+			})
+			return
+		}
+		q.Top = int32(top)
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer func() {
+		cancel()
+	}()
+	response := stats(ctx, q)
+	writeJsonResponse(w, int(response.Code), response)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"github.com/julienschmidt/httprouter"
+	. "hermes/core"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+/**
+retrieveRetention shows the effective retention of the tag given in query, or
+of every known tag. Tags that are only named in the configuration are listed
+too.
+*/
+func retrieveRetention(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	response := OutputRetentionMessage{
+		OutputMessage: OutputMessage{
+			Code:    http.StatusOK,
+			Message: "OK",
+		},
+	}
+
+	tags := make([]string, 0)
+	if tag := strings.TrimSpace(r.URL.Query().Get("tag")); tag != "" {
+		tags = append(tags, tag)
+	} else {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer func() {
+			cancel()
+		}()
+		list, err := mainStorage.FindAllTag(ctx)
+		if err != nil {
+			response.Code = http.StatusInternalServerError
+			response.Message = err.Error()
+			writeJsonResponse(w, http.StatusOK, response)
+			return
+		}
+		seen := make(map[string]bool)
+		for _, tag := range list {
+			seen[tag] = true
+		}
+		for tag := range config.Retention.Tags {
+			seen[tag] = true
+		}
+		for tag := range seen {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+	}
+
+	response.Data = make([]RetentionPolicy, 0, len(tags))
+	for _, tag := range tags {
+		response.Data = append(response.Data, config.Retention.Policy(tag))
+	}
+	writeJsonResponse(w, http.StatusOK, response)
+}
+
+/**
+explainId decodes an id given in any encoding accepted by the API.
+*/
+func explainId(w http.ResponseWriter, _ *http.Request, ps httprouter.Params) {
+	v, err := parseLogId(ps.ByName("id"))
+	if err != nil {
+		writeJsonResponse(w, http.StatusBadRequest, OutputMessage{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		})
+		return
+	}
+	id := ParseInt64(v)
+	writeJsonResponse(w, http.StatusOK, OutputIdMessage{
+		OutputMessage: OutputMessage{
+			Code:    http.StatusOK,
+			Message: "OK",
+		},
+		Data: &IdInfo{
+			Id:     id.Int64(),
+			IdStr:  id.String(),
+			Base58: id.Base58(),
+			Base32: id.Base32(),
+			Time:   id.Time(),
+			Date:   time.Unix(0, id.Time()*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano),
+			Node:   id.Node(),
+			Step:   id.Step(),
+		},
+	})
+}
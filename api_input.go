@@ -2,59 +2,431 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
 	. "hermes/core"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
 	"strings"
 )
 
+var (
+	errBodyTooLarge        = errors.New("request body is too large")
+	errUnsupportedEncoding = errors.New("content encoding is not supported")
+)
+
+/**
+limitReader fails once more than n bytes are read, unlike io.LimitReader which
+would silently cut the body.
+*/
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, errBodyTooLarge
+	}
+	return n, err
+}
+
+/**
+decodeBody decompresses the body as it is read according to its
+Content-Encoding. The limit applies to the decompressed bytes so that a small
+compressed body can not expand beyond it.
+*/
+func decodeBody(r *http.Request, limit int64) (io.Reader, func(), error) {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		return &limitReader{r: r.Body, n: limit}, func() {}, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &limitReader{r: zr, n: limit}, func() { _ = zr.Close() }, nil
+	case "zstd":
+		zr, err := zstd.NewReader(r.Body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(limit)))
+		if err != nil {
+			return nil, nil, err
+		}
+		return &limitReader{r: zr, n: limit}, zr.Close, nil
+	case "snappy", "x-snappy-framed":
+		/** s2 reads the framed format of snappy */
+		return &limitReader{r: s2.NewReader(r.Body), n: limit}, func() {}, nil
+	}
+	return nil, nil, fmt.Errorf("%w: %s", errUnsupportedEncoding, encoding)
+}
+
 func collectLog(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	/** immediately response to client */
-	w.WriteHeader(http.StatusOK)
-	_, err := fmt.Fprintln(w, "OK")
-	if err != nil {
-		log.Printf("send response to agent get error %v\n", err)
+	defer func() {
+		_ = r.Body.Close()
+	}()
+
+	ack := config.Ingest.Ack
+	if v := r.URL.Query().Get("ack"); !StrIsEmpty(v) {
+		ack = strings.ToLower(strings.TrimSpace(v))
+	}
+
+	if ack == AckNone {
+		/** immediately response to client */
+		w.WriteHeader(http.StatusOK)
+		_, err := fmt.Fprintln(w, "OK")
+		if err != nil {
+			log.Printf("send response to agent get error %v\n", err)
+		}
+		/** end response */
+	}
+
+	response := OutputIngestMessage{
+		OutputMessage: OutputMessage{
+			Code:    http.StatusOK,
+			Message: "OK",
+		},
+	}
+
+	if !IsValidAckMode(ack) {
+		response.Code = http.StatusBadRequest
+		response.Message = fmt.Sprintf("ack mode %s is not supported", ack)
+		writeJsonResponse(w, int(response.Code), response)
+		return
 	}
-	/** end response */
 
 	tagValues := r.URL.Query()["tag"]
 	if tagValues == nil || len(tagValues) == 0 {
 		log.Println("missing tag")
+		if ack != AckNone {
+			response.Code = http.StatusBadRequest
+			response.Message = "missing tag"
+			writeJsonResponse(w, int(response.Code), response)
+		}
 		return
 	}
 	tag := strings.TrimSpace(tagValues[0])
-	defer func() {
-		_ = r.Body.Close()
-	}()
-	data, err := ioutil.ReadAll(r.Body)
-	scanner := bufio.NewScanner(strings.NewReader(string(data)))
 
-	inputs := make([]InputLogPayload, 0)
-	for scanner.Scan() {
-		text := scanner.Text()
-		if text != "" {
-			var inputLog InputLogPayload
-			err = json.Unmarshal([]byte(text), &inputLog)
-			if err != nil {
-				log.Println("can not unmarshal log from json", err)
-				continue
+	body, closeBody, err := decodeBody(r, config.Ingest.MaxBodySize)
+	if err != nil {
+		log.Printf("decode log body get error %v\n", err)
+		if ack != AckNone {
+			response.Code = http.StatusBadRequest
+			if errors.Is(err, errUnsupportedEncoding) {
+				response.Code = http.StatusUnsupportedMediaType
+			}
+			response.Message = err.Error()
+			writeJsonResponse(w, int(response.Code), response)
+		}
+		return
+	}
+	defer closeBody()
+
+	parser := newLogParser(tag, strings.TrimSpace(r.Header.Get("Idempotency-Key")), body)
+	for {
+		inputs, first, readErr := parser.next()
+
+		var keys []string
+		if dedup != nil {
+			var duplicates int
+			inputs, keys, duplicates = dedup.reserve(inputs)
+			response.Duplicates += duplicates
+		}
+
+		code, driverErrors, stored := deliverLog(r.Context(), inputs, ack)
+		if dedup != nil {
+			/** the retry of a chunk that the main storage missed must go through */
+			if stored {
+				dedup.confirm(keys)
+			} else {
+				dedup.release(keys)
+			}
+		}
+		if len(driverErrors) > 0 && !stored {
+			/** the lines from the first one of the chunk must be sent again */
+			last := parser.line
+			if readErr == nil {
+				skipped, err := parser.skip()
+				if err != nil {
+					log.Printf("read log body get error %v\n", err)
+				}
+				response.NotAttempted = skipped
+			}
+			log.Printf("logs of tag %s from line %d to %d are not accepted by storage, %d lines after them are not attempted. %v\n",
+				tag, first, last, response.NotAttempted, driverErrors)
+			response.Code = code
+			if code == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", "1")
 			}
-			if StrIsEmpty(inputLog.Message) {
-				continue
+			response.Message = fmt.Sprintf("logs from line %d are not accepted by storage", first)
+			response.Rejected += len(inputs)
+			for i := range driverErrors {
+				driverErrors[i].Line = first
+			}
+			response.Errors = append(response.Errors, driverErrors...)
+			break
+		}
+		if len(driverErrors) > 0 {
+			/** the main storage has the chunk, only other drivers missed it */
+			log.Printf("logs of tag %s from line %d to %d are not accepted by every driver. %v\n",
+				tag, first, parser.line, driverErrors)
+			response.Code = code
+			response.Message = fmt.Sprintf("logs from line %d are not accepted by every driver", first)
+			for i := range driverErrors {
+				driverErrors[i].Line = first
+			}
+			response.Errors = append(response.Errors, driverErrors...)
+		}
+		tails.publish(inputs)
+		response.Accepted += len(inputs)
+
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			/** the logs read so far are kept, the rest of the body is lost */
+			log.Printf("read log body get error %v\n", readErr)
+			response.Code = http.StatusBadRequest
+			if readErr == errBodyTooLarge || errors.Is(readErr, zstd.ErrDecoderSizeExceeded) {
+				response.Code = http.StatusRequestEntityTooLarge
 			}
-			inputLog.Tag = tag
-			inputs = append(inputs, inputLog)
+			response.Message = fmt.Sprintf("body can not be read from line %d", parser.line+1)
+			response.Errors = append(response.Errors, IngestError{Line: parser.line + 1, Error: readErr.Error()})
+			break
 		}
 	}
+	response.Rejected += len(parser.errs)
+	response.Errors = append(parser.errs, response.Errors...)
+	if response.Code == http.StatusOK && response.Accepted == 0 && response.Duplicates == 0 && response.Rejected > 0 {
+		response.Code = http.StatusBadRequest
+		response.Message = "no log line is accepted"
+	}
+
+	if ack != AckNone {
+		writeJsonResponse(w, int(response.Code), response)
+	}
+}
+
+/**
+chunks are also cut when their lines add up to this size
+*/
+const maxChunkBytes = 8 << 20
+
+/**
+logParser reads the body line by line and hands its logs out by chunks, so
+that only a chunk and a line of the body are held in memory. Lines that can
+not be decoded or are longer than the limit are reported with their line
+number so that agents are able to resend only these lines. Lines without
+event id get one made of the idempotency key of the request and their line
+number.
+*/
+type logParser struct {
+	tag       string
+	key       string
+	reader    *bufio.Reader
+	maxLine   int
+	chunkSize int
+	line      int
+	buf       []byte
+	errs      []IngestError
+}
 
-	for name, driver := range drivers {
-		err = driver.Collect(inputs)
+func newLogParser(tag string, key string, body io.Reader) *logParser {
+	return &logParser{
+		tag:       tag,
+		key:       key,
+		reader:    bufio.NewReaderSize(body, 64*1024),
+		maxLine:   config.Ingest.MaxLineSize,
+		chunkSize: config.Ingest.ChunkSize,
+		errs:      make([]IngestError, 0),
+	}
+}
+
+/**
+next returns the next chunk of logs with the number of its first line. The
+error is io.EOF along with the last chunk, or the error that stopped reading
+the body, the logs read before it are still returned.
+*/
+func (p *logParser) next() ([]InputLogPayload, int, error) {
+	inputs := make([]InputLogPayload, 0)
+	first := p.line + 1
+	size := 0
+	for len(inputs) < p.chunkSize && size < maxChunkBytes {
+		text, tooLong, err := p.readLine()
 		if err != nil {
-			log.Printf("collect log in driver %s get error %v \n", name, err)
+			return inputs, first, err
+		}
+		if tooLong {
+			p.errs = append(p.errs, IngestError{
+				Line:  p.line,
+				Error: fmt.Sprintf("line is longer than %d bytes", p.maxLine),
+			})
+			continue
+		}
+		if len(text) == 0 {
+			continue
+		}
+		var inputLog InputLogPayload
+		err = json.Unmarshal(text, &inputLog)
+		if err != nil {
+			log.Println("can not unmarshal log from json", err)
+			p.errs = append(p.errs, IngestError{Line: p.line, Error: err.Error()})
+			continue
+		}
+		if StrIsEmpty(inputLog.Message) {
+			p.errs = append(p.errs, IngestError{Line: p.line, Error: "missing message"})
+			continue
+		}
+		inputLog.Tag = p.tag
+		if StrIsEmpty(inputLog.EventId) && p.key != "" {
+			inputLog.EventId = fmt.Sprintf("%s:%d", p.key, p.line)
+		}
+		inputs = append(inputs, inputLog)
+		size += len(text)
+	}
+	return inputs, first, nil
+}
+
+/**
+skip reads the rest of the body and returns the number of its lines.
+*/
+func (p *logParser) skip() (int, error) {
+	from := p.line
+	for {
+		_, _, err := p.readLine()
+		if err == io.EOF {
+			return p.line - from, nil
+		}
+		if err != nil {
+			return p.line - from, err
+		}
+	}
+}
+
+/**
+readLine returns the next line without its line ending. A line longer than
+maxLine is read to its end but not kept, tooLong is set instead.
+*/
+func (p *logParser) readLine() (text []byte, tooLong bool, err error) {
+	p.buf = p.buf[:0]
+	read := 0
+	for {
+		chunk, e := p.reader.ReadSlice('\n')
+		read += len(chunk)
+		/** room for the line ending */
+		if !tooLong && len(p.buf)+len(chunk) <= p.maxLine+2 {
+			p.buf = append(p.buf, chunk...)
+		} else {
+			tooLong = true
+		}
+		if e == bufio.ErrBufferFull {
+			continue
+		}
+		if e == io.EOF && read > 0 {
+			/** the last line has no line ending, io.EOF comes with the next call */
+			e = nil
+		}
+		if e != nil {
+			return nil, false, e
+		}
+		p.line++
+		text = bytes.TrimRight(p.buf, "\r\n")
+		if len(text) > p.maxLine {
+			tooLong = true
+		}
+		return text, tooLong, nil
+	}
+}
+
+/**
+deliverLog passes the batch to the configured drivers and returns the errors
+of the drivers that the ack mode waits for, along with the status code to
+answer. Failures of other drivers are only logged. stored tells whether the
+write-ahead log or the main storage accepted the batch, the main storage is
+only known to fail when the ack mode waits for it.
+
+When the write-ahead log is enabled the batch is accepted as soon as it is
+synced to the log, drivers get it from the replay loops. Otherwise the batch
+is pushed to the queue of every driver, main storage first so that a full
+main queue rejects the batch before anything else sees it.
+*/
+func deliverLog(ctx context.Context, inputs []InputLogPayload, ack string) (int32, []IngestError, bool) {
+	errs := make([]IngestError, 0)
+	if len(inputs) == 0 {
+		return http.StatusOK, errs, false
+	}
+	if writeAheadLog != nil {
+		err := appendWriteAheadLog(inputs)
+		if err != nil {
+			log.Printf("append batch to wal get error %v\n", err)
+			errs = append(errs, IngestError{Driver: "wal", Error: err.Error()})
+			return http.StatusServiceUnavailable, errs, false
+		}
+		return http.StatusOK, errs, true
+	}
+
+	queues := make([]*driverQueue, 0, len(driverQueues))
+	queues = append(queues, driverQueues[mainStorageName])
+	for name, q := range driverQueues {
+		if name != mainStorageName {
+			queues = append(queues, q)
+		}
+	}
+
+	code := int32(http.StatusOK)
+	waits := make(map[string]chan error)
+	for _, q := range queues {
+		wait := ack == AckAll || (ack == AckMain && q.main)
+		item := &queueItem{inputs: inputs}
+		if wait {
+			item.done = make(chan error, 1)
+		}
+		err := q.push(ctx, item)
+		if err != nil {
+			log.Printf("push batch to queue of driver %s get error %v\n", q.name, err)
+			if q.main {
+				code = http.StatusServiceUnavailable
+				if err == errQueueFull {
+					code = http.StatusTooManyRequests
+				}
+				errs = append(errs, IngestError{Driver: q.name, Error: err.Error()})
+				return code, errs, false
+			}
+			if wait {
+				code = http.StatusServiceUnavailable
+				errs = append(errs, IngestError{Driver: q.name, Error: err.Error()})
+			}
+			continue
+		}
+		if wait {
+			waits[q.name] = item.done
+		}
+	}
+
+	stored := true
+	for name, done := range waits {
+		if err := <-done; err != nil {
+			code = http.StatusServiceUnavailable
+			errs = append(errs, IngestError{Driver: name, Error: err.Error()})
+			if name == mainStorageName {
+				stored = false
+			}
 		}
 	}
+	return code, errs, stored
 }
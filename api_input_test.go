@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	. "hermes/core"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimitReader(t *testing.T) {
+	b, err := ioutil.ReadAll(&limitReader{r: strings.NewReader("0123456789"), n: 10})
+	if err != nil || string(b) != "0123456789" {
+		t.Fatalf("expected a body of the limit to be read, got %q, %v", b, err)
+	}
+
+	b, err = ioutil.ReadAll(&limitReader{r: strings.NewReader("0123456789"), n: 9})
+	if err != errBodyTooLarge {
+		t.Fatalf("expected errBodyTooLarge, got %v", err)
+	}
+	if len(b) > 10 {
+		t.Fatalf("expected no more than one byte beyond the limit, got %d bytes", len(b))
+	}
+
+	l := &limitReader{r: strings.NewReader("0123456789"), n: 4}
+	if _, err := io.Copy(ioutil.Discard, l); err != errBodyTooLarge {
+		t.Fatalf("expected errBodyTooLarge, got %v", err)
+	}
+	if n, err := l.Read(make([]byte, 8)); n != 0 || err != errBodyTooLarge {
+		t.Fatalf("expected reads to keep failing, got %d, %v", n, err)
+	}
+}
+
+func encodeBody(t *testing.T, encoding string, body []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zstd":
+		var err error
+		if w, err = zstd.NewWriter(&buf); err != nil {
+			t.Fatal(err)
+		}
+	case "snappy":
+		w = s2.NewWriter(&buf, s2.WriterSnappyCompat())
+	default:
+		return body
+	}
+	if _, err := w.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readDecodedBody(t *testing.T, encoding string, body []byte, limit int64) ([]byte, error) {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/api/log?tag=web", bytes.NewReader(encodeBody(t, encoding, body)))
+	r.Header.Set("Content-Encoding", encoding)
+	reader, closeBody, err := decodeBody(r, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBody()
+	return ioutil.ReadAll(reader)
+}
+
+func TestDecodeBody(t *testing.T) {
+	body := bytes.Repeat([]byte("a log line\n"), 1000)
+	for _, encoding := range []string{"", "identity", "gzip", "zstd", "snappy"} {
+		decoded, err := readDecodedBody(t, encoding, body, int64(len(body)))
+		if err != nil {
+			t.Fatalf("decode %q body get error %v", encoding, err)
+		}
+		if !bytes.Equal(decoded, body) {
+			t.Fatalf("decoded %q body differs", encoding)
+		}
+	}
+}
+
+func TestDecodeBodyLimit(t *testing.T) {
+	body := bytes.Repeat([]byte("a log line\n"), 1000)
+	for _, encoding := range []string{"", "gzip", "zstd", "snappy"} {
+		_, err := readDecodedBody(t, encoding, body, int64(len(body))-1)
+		if err != errBodyTooLarge && !errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+			t.Fatalf("expected decompressed %q body to exceed the limit, got %v", encoding, err)
+		}
+	}
+}
+
+func TestDecodeBodyUnsupported(t *testing.T) {
+	if _, err := readDecodedBody(t, "br", []byte("a log line\n"), 1024); !errors.Is(err, errUnsupportedEncoding) {
+		t.Fatalf("expected errUnsupportedEncoding, got %v", err)
+	}
+	r := httptest.NewRequest("POST", "/api/log?tag=web", strings.NewReader("not gzip"))
+	r.Header.Set("Content-Encoding", "gzip")
+	if _, _, err := decodeBody(r, 1024); err == nil {
+		t.Fatal("expected an invalid gzip body to be rejected")
+	}
+}
+
+func parseAll(t *testing.T, p *logParser) ([][]InputLogPayload, []int) {
+	t.Helper()
+	chunks := make([][]InputLogPayload, 0)
+	firsts := make([]int, 0)
+	for {
+		inputs, first, err := p.next()
+		chunks = append(chunks, inputs)
+		firsts = append(firsts, first)
+		if err == io.EOF {
+			return chunks, firsts
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testParser(body string, maxLine int, chunkSize int) *logParser {
+	p := newLogParser("web", "", strings.NewReader(body))
+	p.maxLine = maxLine
+	p.chunkSize = chunkSize
+	return p
+}
+
+func TestLogParserChunks(t *testing.T) {
+	body := "{\"message\":\"a\"}\r\n\n{\"message\":\"b\"}\n{\"message\":\"c\"}\r\n{\"message\":\"d\"}"
+	chunks, firsts := parseAll(t, testParser(body, 1024, 2))
+	if len(chunks) != 3 || len(chunks[0]) != 2 || len(chunks[1]) != 2 || len(chunks[2]) != 0 {
+		t.Fatalf("expected 2 chunks of 2 logs before the end of the body, got %+v", chunks)
+	}
+	if firsts[0] != 1 || firsts[1] != 4 {
+		t.Fatalf("expected chunks from lines 1 and 4, got %v", firsts)
+	}
+	if chunks[0][0].Message != "a" || chunks[1][1].Message != "d" || chunks[1][1].Tag != "web" {
+		t.Fatalf("unexpected logs %+v", chunks)
+	}
+}
+
+func TestLogParserInvalidLines(t *testing.T) {
+	long := "{\"message\":\"" + strings.Repeat("x", 100*1024) + "\"}"
+	body := "{\"message\":\"a\"}\n" + long + "\nnot json\n{\"level\":\"INFO\"}\n" + long + "\r\n{\"message\":\"b\"}\n"
+	p := testParser(body, 1024, 10)
+	chunks, _ := parseAll(t, p)
+	if len(chunks[0]) != 2 || chunks[0][1].Message != "b" {
+		t.Fatalf("expected the valid lines around the invalid ones, got %+v", chunks)
+	}
+	lines := make([]int, len(p.errs))
+	for i, e := range p.errs {
+		lines[i] = e.Line
+	}
+	if len(lines) != 4 || lines[0] != 2 || lines[1] != 3 || lines[2] != 4 || lines[3] != 5 {
+		t.Fatalf("expected errors of lines 2 to 5, got %+v", p.errs)
+	}
+	if p.line != 6 {
+		t.Fatalf("expected 6 lines, got %d", p.line)
+	}
+}
+
+func TestLogParserLineLimit(t *testing.T) {
+	line := "{\"message\":\"" + strings.Repeat("x", 88) + "\"}"
+	for body, expected := range map[string]int{
+		line:                     1,
+		line + "\n":              1,
+		line + "\r\n":            1,
+		line + "x\n":             0,
+		strings.Repeat("\n", 3):  0,
+		"\r\n" + line + "\r\n\n": 1,
+	} {
+		chunks, _ := parseAll(t, testParser(body, len(line), 10))
+		if len(chunks[0]) != expected {
+			t.Errorf("expected %d logs of body %q, got %d", expected, body, len(chunks[0]))
+		}
+	}
+}
+
+func TestLogParserEventIds(t *testing.T) {
+	p := testParser("{\"message\":\"a\"}\n{\"message\":\"b\",\"event_id\":\"e\"}\n", 1024, 10)
+	p.key = "req-1"
+	chunks, _ := parseAll(t, p)
+	if chunks[0][0].EventId != "req-1:1" || chunks[0][1].EventId != "e" {
+		t.Fatalf("unexpected event ids %+v", chunks[0])
+	}
+}
+
+func TestLogParserSkip(t *testing.T) {
+	p := testParser("{\"message\":\"a\"}\n{\"message\":\"b\"}\n\nnot json\n{\"message\":\"c\"}", 1024, 1)
+	if _, _, err := p.next(); err != nil {
+		t.Fatal(err)
+	}
+	skipped, err := p.skip()
+	if err != nil || skipped != 4 {
+		t.Fatalf("expected 4 lines to be skipped, got %d, %v", skipped, err)
+	}
+}
+
+type failingDriver struct {
+	LogDriver
+	calls  int
+	failAt int
+}
+
+func (d *failingDriver) Collect(messages []InputLogPayload) error {
+	d.calls++
+	if d.calls == d.failAt {
+		return errors.New("storage is down")
+	}
+	return nil
+}
+
+func setupIngest(t *testing.T, queue QueueConfig, driver LogDriver) *driverQueue {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	savedConfig, savedQueues, savedMain, savedDedup := config, driverQueues, mainStorageName, dedup
+	t.Cleanup(func() {
+		cancel()
+		config, driverQueues, mainStorageName, dedup = savedConfig, savedQueues, savedMain, savedDedup
+	})
+
+	config.Ingest = IngestConfig{Ack: AckMain, MaxBodySize: 1 << 20, MaxLineSize: 1024, ChunkSize: 2}
+	q, err := openDriverQueue(ctx, DriverConfig{Name: "main", IsMainStorage: true, Queue: queue}, driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	driverQueues = map[string]*driverQueue{"main": q}
+	mainStorageName = "main"
+	dedup, err = openDedupSet(DedupConfig{Window: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func postLogs(t *testing.T, eventIds ...string) OutputIngestMessage {
+	t.Helper()
+	var body strings.Builder
+	for _, id := range eventIds {
+		_, _ = fmt.Fprintf(&body, "{\"message\":\"m\",\"event_id\":%q}\n", id)
+	}
+	w := httptest.NewRecorder()
+	collectLog(w, httptest.NewRequest("POST", "/api/log?tag=web", strings.NewReader(body.String())), nil)
+	var response OutputIngestMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if int(response.Code) != w.Code {
+		t.Fatalf("status %d differs from code %d", w.Code, response.Code)
+	}
+	return response
+}
+
+func TestCollectLogChunkRefused(t *testing.T) {
+	setupIngest(t, QueueConfig{Size: 4, Workers: 1, Overflow: OverflowBlock}, &failingDriver{failAt: 2})
+
+	response := postLogs(t, "e1", "e2", "e3", "e4", "e5")
+	if response.Code != http.StatusServiceUnavailable || response.Accepted != 2 || response.Rejected != 2 ||
+		response.NotAttempted != 1 {
+		t.Fatalf("unexpected response %+v", response)
+	}
+	if len(response.Errors) != 1 || response.Errors[0].Line != 3 || response.Errors[0].Driver != "main" {
+		t.Fatalf("expected the refused chunk from line 3, got %+v", response.Errors)
+	}
+
+	/** the main storage missed the chunk, the retry goes through */
+	response = postLogs(t, "e1", "e2", "e3", "e4", "e5")
+	if response.Code != http.StatusOK || response.Accepted != 3 || response.Duplicates != 2 {
+		t.Fatalf("expected the refused logs to be accepted on retry, got %+v", response)
+	}
+}
+
+func TestCollectLogSecondaryRefused(t *testing.T) {
+	setupIngest(t, QueueConfig{Size: 4, Workers: 1, Overflow: OverflowBlock}, &failingDriver{})
+	config.Ingest.Ack = AckAll
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	secondary, err := openDriverQueue(ctx, DriverConfig{Name: "file", Queue: QueueConfig{Size: 4, Workers: 1}},
+		&failingDriver{failAt: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	driverQueues["file"] = secondary
+
+	response := postLogs(t, "e1", "e2", "e3")
+	if response.Code != http.StatusServiceUnavailable || response.Accepted != 3 || response.Rejected != 0 {
+		t.Fatalf("expected the logs stored by the main storage to be accepted, got %+v", response)
+	}
+	if len(response.Errors) != 1 || response.Errors[0].Line != 1 || response.Errors[0].Driver != "file" {
+		t.Fatalf("expected the error of the other driver from line 1, got %+v", response.Errors)
+	}
+
+	/** the main storage has the logs, the retry must not store them twice */
+	response = postLogs(t, "e1", "e2", "e3")
+	if response.Code != http.StatusOK || response.Accepted != 0 || response.Duplicates != 3 {
+		t.Fatalf("expected the retry to be deduplicated, got %+v", response)
+	}
+}
+
+func TestCollectLogMainQueueFull(t *testing.T) {
+	q := setupIngest(t, QueueConfig{Size: 1, Overflow: OverflowBlock}, &failingDriver{})
+	if err := q.push(context.Background(), &queueItem{}); err != nil {
+		t.Fatal(err)
+	}
+
+	response := postLogs(t, "e1", "e2", "e3")
+	if response.Code != http.StatusTooManyRequests || response.Accepted != 0 || response.Rejected != 2 ||
+		response.NotAttempted != 1 {
+		t.Fatalf("unexpected response %+v", response)
+	}
+
+	/** nothing took the chunk, the retry goes through */
+	kept, keys, _ := dedup.reserve(dedupInputs("e1", "e2"))
+	if len(kept) != 2 {
+		t.Fatalf("expected event ids of the rejected chunk to be released, got %+v", kept)
+	}
+	dedup.release(keys)
+}
@@ -3,44 +3,643 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
 	. "hermes/core"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func retrieveListOfTag(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+const (
+	defaultQueryLimit = 1000
+	maxQueryLimit     = 10000
+	ndjsonContentType = "application/x-ndjson"
+
+	defaultCatalogDays = 7
+	maxCatalogDays     = 90
+
+	defaultContextTop = 20
+	maxContextTop     = 1000
+
+	defaultSurroundingLines = 10
+	maxSurroundingLines     = 1000
+)
+
+func writeJsonResponse(w http.ResponseWriter, status int, i interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Server", fmt.Sprintf("hermes %s", version))
-	writeResponse := func(w http.ResponseWriter, i interface{}) {
-		bytes, err := json.Marshal(i)
+	bytes, err := json.Marshal(i)
+	if err != nil {
+		log.Println("marshal response get error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = fmt.Fprintln(w, err.Error())
+		return
+	}
+	w.WriteHeader(status)
+	_, _ = w.Write(bytes)
+}
+
+func retrieveListOfTag(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	response := OutputTagMessage{
+		OutputMessage: OutputMessage{
+			Code:    http.StatusOK,
+			Message: "OK",
+		},
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer func() {
+		cancel()
+	}()
+	list, err := mainStorage.FindAllTag(ctx)
+	if err != nil {
+		response.Code = http.StatusInternalServerError
+		response.Message = err.Error()
+	} else {
+		response.Data = list
+	}
+	writeJsonResponse(w, http.StatusOK, response)
+}
+
+func parseLogQuery(r *http.Request) (q LogQuery, err error) {
+	values := r.URL.Query()
+	q = LogQuery{
+		Tag:    values.Get("tag"),
+		Order:  values.Get("order"),
+		LastId: values.Get("last_id"),
+	}
+
+	if v := values.Get("level"); v != "" {
+		level, e := strconv.Atoi(v)
+		if e != nil {
+			q.LogLevel = LogLevelInt(v)
+		} else {
+			q.LogLevel = int32(level)
+		}
+	}
+
+	for name, target := range map[string]*int64{
+		"start":          &q.Start,
+		"end":            &q.End,
+		"last_timestamp": &q.LastTimestamp,
+	} {
+		if v := values.Get(name); v != "" {
+			*target, err = strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				err = fmt.Errorf("%s must be a number", name)
+				return
+			}
+		}
+	}
+	if q.End == 0 {
+		q.End = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+
+	if v := values.Get("limit"); v != "" {
+		var limit int64
+		limit, err = strconv.ParseInt(v, 10, 32)
 		if err != nil {
-			log.Println("marshal response get error", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			_, _ = fmt.Fprintln(w, err.Error())
+			err = fmt.Errorf("limit must be a number")
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write(bytes)
+		q.Limit = int32(limit)
 	}
 
-	response := OutputTagMessage{
+	if v := values.Get("backward"); v != "" {
+		q.Backward, err = strconv.ParseBool(v)
+		if err != nil {
+			err = fmt.Errorf("backward must be true or false")
+			return
+		}
+	}
+
+	/** one message filter: search, search_mode, search_ci and search_not */
+	if v := values.Get("search"); v != "" {
+		f := MessageFilter{
+			Mode:    values.Get("search_mode"),
+			Pattern: v,
+		}
+		for name, target := range map[string]*bool{
+			"search_ci":  &f.CaseInsensitive,
+			"search_not": &f.Negate,
+		} {
+			if v := values.Get(name); v != "" {
+				*target, err = strconv.ParseBool(v)
+				if err != nil {
+					err = fmt.Errorf("%s must be true or false", name)
+					return
+				}
+			}
+		}
+		q.Message = append(q.Message, f)
+	}
+
+	q.Containers = values["container"]
+	q.ExcludeContainers = values["exclude_container"]
+
+	/** context filters as key:op:value, values of "in" are separated by comma */
+	for _, v := range values["context"] {
+		parts := strings.SplitN(v, ":", 3)
+		f := ContextFilter{Key: parts[0]}
+		if len(parts) > 1 {
+			f.Op = parts[1]
+		}
+		if len(parts) > 2 {
+			if f.Op == ContextIn {
+				f.Values = strings.Split(parts[2], ",")
+			} else {
+				f.Value = parts[2]
+			}
+		}
+		q.Context = append(q.Context, f)
+	}
+	return
+}
+
+/**
+fetchLog runs the query against the main storage and makes sure the response
+channel always ends with a message whose code is not 200.
+*/
+func fetchLog(ctx context.Context, opt QueryLogOption) {
+	err := mainStorage.FetchingLog(ctx, opt)
+	if err != nil {
+		opt.Response <- OutputLogMessage{
+			OutputMessage: OutputMessage{
+				Code:    http.StatusInternalServerError,
+				Message: err.Error(),
+			},
+		}
+	}
+}
+
+/**
+wantNdjson tells whether the client asked for the rows as newline delimited
+JSON, which is streamed while the query runs.
+*/
+func wantNdjson(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "ndjson" ||
+		strings.Contains(r.Header.Get("Accept"), ndjsonContentType)
+}
+
+func queryLog(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	query, err := parseLogQuery(r)
+	runLogQuery(w, r, query, err)
+}
+
+func queryLogByBody(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer func() {
+		_ = r.Body.Close()
+	}()
+	var query LogQuery
+	err := json.NewDecoder(r.Body).Decode(&query)
+	if err != nil {
+		err = fmt.Errorf("can not unmarshal query %v", err)
+	} else if query.End == 0 {
+		query.End = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+	runLogQuery(w, r, query, err)
+}
+
+func runLogQuery(w http.ResponseWriter, r *http.Request, query LogQuery, err error) {
+	response := OutputLogMessage{
 		OutputMessage: OutputMessage{
 			Code:    http.StatusOK,
 			Message: "OK",
 		},
+		Data: make([]OutputLogPayload, 0),
+	}
+
+	streaming := wantNdjson(r)
+	if !streaming {
+		if err == nil && query.Limit > maxQueryLimit {
+			err = fmt.Errorf("limit must not be larger than %d", maxQueryLimit)
+		}
+		if query.Limit == 0 {
+			query.Limit = defaultQueryLimit
+		}
 	}
+	channel := make(chan OutputLogMessage)
+	var opt QueryLogOption
+	if err == nil {
+		opt, err = query.option(defaultQueryLimit, channel)
+	}
+	if err != nil {
+		response.Code = http.StatusBadRequest
+		response.Message = err.Error()
+		writeJsonResponse(w, http.StatusBadRequest, response)
+		return
+	}
+
 	ctx, cancel := context.WithCancel(r.Context())
 	defer func() {
 		cancel()
 	}()
-	list, err := mainStorage.FindAllTag(ctx)
+	go fetchLog(ctx, opt)
+
+	if streaming {
+		streamLog(w, channel)
+		return
+	}
+
+	for msg := range channel {
+		if msg.Code == http.StatusOK {
+			response.Data = append(response.Data, msg.Data...)
+			continue
+		}
+		if msg.Code == http.StatusNoContent {
+			response.Cursor = msg.Cursor
+		} else {
+			response.OutputMessage = msg.OutputMessage
+		}
+		break
+	}
+	writeJsonResponse(w, int(response.Code), response)
+}
+
+/**
+streamLog writes one row per line as batches arrive. The last line is the
+closing message of the query: its code, message and cursor.
+*/
+func streamLog(w http.ResponseWriter, channel chan OutputLogMessage) {
+	w.Header().Set("Content-Type", ndjsonContentType)
+	w.Header().Set("Server", fmt.Sprintf("hermes %s", version))
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	for msg := range channel {
+		if msg.Code != http.StatusOK {
+			if err := encoder.Encode(msg); err != nil {
+				log.Printf("stream log to client get error %v\n", err)
+			}
+			break
+		}
+		for _, row := range msg.Data {
+			if err := encoder.Encode(row); err != nil {
+				log.Printf("stream log to client get error %v\n", err)
+				/** keep draining, the query is cancelled with the request */
+				break
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+/**
+retrieveTagCatalog lists the tags with their first and last log, their count
+per level and per day and the keys of their context. It is sorted by name,
+last_seen, count (every log) or volume (the logs of the last days).
+*/
+func retrieveTagCatalog(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	response := OutputCatalogMessage{
+		OutputMessage: OutputMessage{
+			Code:    http.StatusOK,
+			Message: "OK",
+		},
+	}
+
+	cataloger, ok := mainStorage.(TagCataloger)
+	if !ok {
+		response.Code = http.StatusNotImplemented
+		response.Message = "main storage has no tag catalog"
+		writeJsonResponse(w, http.StatusNotImplemented, response)
+		return
+	}
+
+	days := defaultCatalogDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		var err error
+		days, err = strconv.Atoi(v)
+		if err != nil || days < 0 || days > maxCatalogDays {
+			response.Code = http.StatusBadRequest
+			response.Message = fmt.Sprintf("days must be between 0 and %d", maxCatalogDays)
+			writeJsonResponse(w, http.StatusBadRequest, response)
+			return
+		}
+	}
+
+	var less func(a, b TagInfo) bool
+	switch r.URL.Query().Get("sort") {
+	case "", "name":
+		break
+	case "last_seen":
+		less = func(a, b TagInfo) bool { return a.LastSeen > b.LastSeen }
+		break
+	case "count":
+		less = func(a, b TagInfo) bool { return a.Count > b.Count }
+		break
+	case "volume":
+		less = func(a, b TagInfo) bool { return volumeOf(a) > volumeOf(b) }
+		break
+	default:
+		response.Code = http.StatusBadRequest
+		response.Message = fmt.Sprintf("sort %s is not supported", r.URL.Query().Get("sort"))
+		writeJsonResponse(w, http.StatusBadRequest, response)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer func() {
+		cancel()
+	}()
+	list, err := cataloger.TagCatalog(ctx, days)
+	if err != nil {
+		response.Code = http.StatusInternalServerError
+		response.Message = err.Error()
+		writeJsonResponse(w, http.StatusInternalServerError, response)
+		return
+	}
+	if less != nil {
+		sort.SliceStable(list, func(i, j int) bool {
+			return less(list[i], list[j])
+		})
+	}
+	response.Data = list
+	writeJsonResponse(w, http.StatusOK, response)
+}
+
+func volumeOf(t TagInfo) uint64 {
+	var total uint64
+	for _, v := range t.Volume {
+		total += v.Count
+	}
+	return total
+}
+
+/**
+retrieveListOfContainer counts the logs of every container of a tag within
+the time window of the query.
+*/
+func retrieveListOfContainer(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	response := OutputContainerMessage{
+		OutputMessage: OutputMessage{
+			Code:    http.StatusOK,
+			Message: "OK",
+		},
+	}
+
+	finder, ok := mainStorage.(ContainerFinder)
+	if !ok {
+		response.Code = http.StatusNotImplemented
+		response.Message = "main storage can not list containers"
+		writeJsonResponse(w, http.StatusNotImplemented, response)
+		return
+	}
+
+	query, err := parseLogQuery(r)
+	var opt QueryLogOption
+	if err == nil {
+		opt, err = query.option(0, nil)
+	}
+	if err != nil {
+		response.Code = http.StatusBadRequest
+		response.Message = err.Error()
+		writeJsonResponse(w, http.StatusBadRequest, response)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer func() {
+		cancel()
+	}()
+	list, err := finder.FindContainers(ctx, opt)
 	if err != nil {
 		response.Code = http.StatusInternalServerError
 		response.Message = err.Error()
 	} else {
 		response.Data = list
 	}
-	writeResponse(w, response)
+	writeJsonResponse(w, http.StatusOK, response)
+}
+
+/**
+retrieveListOfContextKey lists the context keys of the logs of a tag with
+their count, for autocompletion. Keys can be narrowed down by prefix.
+*/
+func retrieveListOfContextKey(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	retrieveContext(w, r, false)
+}
+
+/**
+retrieveListOfContextValue lists the most frequent values of the context key
+named by key, narrowed down by prefix.
+*/
+func retrieveListOfContextValue(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	retrieveContext(w, r, true)
+}
+
+func retrieveContext(w http.ResponseWriter, r *http.Request, values bool) {
+	response := OutputContextMessage{
+		OutputMessage: OutputMessage{
+			Code:    http.StatusOK,
+			Message: "OK",
+		},
+	}
+
+	explorer, ok := mainStorage.(ContextExplorer)
+	if !ok {
+		response.Code = http.StatusNotImplemented
+		response.Message = "main storage can not list context"
+		writeJsonResponse(w, http.StatusNotImplemented, response)
+		return
+	}
+
+	opt, err := parseContextOption(r, values)
+	if err != nil {
+		response.Code = http.StatusBadRequest
+		response.Message = err.Error()
+		writeJsonResponse(w, http.StatusBadRequest, response)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer func() {
+		cancel()
+	}()
+	var list []StatsGroup
+	if values {
+		list, err = explorer.ContextValues(ctx, opt)
+	} else {
+		list, err = explorer.ContextKeys(ctx, opt)
+	}
+	if err != nil {
+		response.Code = http.StatusInternalServerError
+		response.Message = err.Error()
+	} else {
+		response.Data = list
+	}
+	writeJsonResponse(w, http.StatusOK, response)
+}
+
+func parseContextOption(r *http.Request, values bool) (opt ContextOption, err error) {
+	query, err := parseLogQuery(r)
+	if err != nil {
+		return
+	}
+	opt.QueryLogOption, err = query.option(0, nil)
+	if err != nil {
+		return
+	}
+
+	opt.Key = r.URL.Query().Get("key")
+	if values && StrIsEmpty(opt.Key) {
+		err = errors.New("missing context key")
+		return
+	}
+	opt.Prefix = r.URL.Query().Get("prefix")
+
+	opt.Top = defaultContextTop
+	if v := r.URL.Query().Get("top"); v != "" {
+		var top int64
+		top, err = strconv.ParseInt(v, 10, 32)
+		if err != nil || top <= 0 || top > maxContextTop {
+			err = fmt.Errorf("top must be between 1 and %d", maxContextTop)
+			return
+		}
+		opt.Top = int32(top)
+	}
+	return
+}
+
+/**
+parseLogId accepts the decimal, base58 and base32 encodings of an id. Their
+alphabets overlap, so the next encoding is tried when an id does not decode to
+a time between the epoch and a minute from now, the clocks of the other nodes
+may be ahead.
+*/
+func parseLogId(v string) (int64, error) {
+	v = strings.TrimSpace(v)
+	latest := time.Now().Add(time.Minute).UnixNano() / int64(time.Millisecond)
+	for _, parse := range []func(string) (ID, error){
+		ParseString,
+		func(s string) (ID, error) { return ParseBase58([]byte(s)) },
+		func(s string) (ID, error) { return ParseBase32([]byte(s)) },
+	} {
+		id, err := parse(v)
+		if err == nil && id > 0 && id.Time() <= latest {
+			return id.Int64(), nil
+		}
+	}
+	return 0, fmt.Errorf("id %s is not valid", v)
+}
+
+/**
+retrieveLog returns the log of id.
+*/
+func retrieveLog(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	response := OutputEntryMessage{
+		OutputMessage: OutputMessage{
+			Code:    http.StatusOK,
+			Message: "OK",
+		},
+	}
+
+	finder, ok := mainStorage.(LogFinder)
+	if !ok {
+		response.Code = http.StatusNotImplemented
+		response.Message = "main storage can not find a log by id"
+		writeJsonResponse(w, http.StatusNotImplemented, response)
+		return
+	}
+
+	id, err := parseLogId(ps.ByName("id"))
+	if err != nil {
+		response.Code = http.StatusBadRequest
+		response.Message = err.Error()
+		writeJsonResponse(w, http.StatusBadRequest, response)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer func() {
+		cancel()
+	}()
+	entry, err := finder.FindLog(ctx, id)
+	switch {
+	case err == ErrLogNotFound:
+		response.Code = http.StatusNotFound
+		response.Message = err.Error()
+		break
+	case err != nil:
+		response.Code = http.StatusInternalServerError
+		response.Message = err.Error()
+		break
+	default:
+		response.Data = &entry
+		break
+	}
+	writeJsonResponse(w, int(response.Code), response)
+}
+
+/**
+retrieveSurrounding lists the before and after logs around the log of id from
+the same tag and container, in (timestamp, id) order like grep -C.
+*/
+func retrieveSurrounding(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	response := OutputLogMessage{
+		OutputMessage: OutputMessage{
+			Code:    http.StatusOK,
+			Message: "OK",
+		},
+	}
+
+	finder, ok := mainStorage.(SurroundingFinder)
+	if !ok {
+		response.Code = http.StatusNotImplemented
+		response.Message = "main storage can not find surrounding logs"
+		writeJsonResponse(w, http.StatusNotImplemented, response)
+		return
+	}
+
+	opt := SurroundingOption{
+		Tag:    r.URL.Query().Get("tag"),
+		Before: defaultSurroundingLines,
+		After:  defaultSurroundingLines,
+	}
+	var err error
+	opt.Id, err = parseLogId(ps.ByName("id"))
+	for name, target := range map[string]*int32{
+		"before": &opt.Before,
+		"after":  &opt.After,
+	} {
+		if v := r.URL.Query().Get(name); err == nil && v != "" {
+			n, e := strconv.ParseInt(v, 10, 32)
+			if e != nil || n < 0 || n > maxSurroundingLines {
+				err = fmt.Errorf("%s must be between 0 and %d", name, maxSurroundingLines)
+			}
+			*target = int32(n)
+		}
+	}
+	if err != nil {
+		response.Code = http.StatusBadRequest
+		response.Message = err.Error()
+		writeJsonResponse(w, http.StatusBadRequest, response)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer func() {
+		cancel()
+	}()
+	list, err := finder.FindSurrounding(ctx, opt)
+	switch {
+	case err == ErrLogNotFound:
+		response.Code = http.StatusNotFound
+		response.Message = err.Error()
+		break
+	case err != nil:
+		response.Code = http.StatusInternalServerError
+		response.Message = err.Error()
+		break
+	default:
+		response.Data = list
+		break
+	}
+	writeJsonResponse(w, int(response.Code), response)
 }
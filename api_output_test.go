@@ -0,0 +1,32 @@
+package main
+
+import (
+	. "hermes/core"
+	"testing"
+)
+
+func TestParseLogId(t *testing.T) {
+	node, err := NewNode(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := node.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{id.String(), id.Base58(), id.Base32(), " " + id.String() + "\n"} {
+		parsed, err := parseLogId(v)
+		if err != nil {
+			t.Fatalf("id %q get error %v", v, err)
+		}
+		if parsed != id.Int64() {
+			t.Fatalf("id %q is parsed to %d, expected %d", v, parsed, id.Int64())
+		}
+	}
+
+	for _, v := range []string{"", "0", "-12", "not-an-id"} {
+		if parsed, err := parseLogId(v); err == nil {
+			t.Errorf("expected id %q to be rejected, got %d", v, parsed)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package clickhouse
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ClickHouse/clickhouse-go"
+	. "hermes/core"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultFlushRows     = 100000
+	DefaultFlushInterval = 1000 * time.Millisecond
+)
+
+var errBatcherClosed = errors.New("batcher is closed")
+
+/**
+Batcher buffers the entries of concurrent callers and writes them to ClickHouse
+as one columnar block, either once flushRows entries are pending or every
+flushInterval. Add only returns when the block holding the entries is
+committed, so a failed flush is reported to every caller that took part in it.
+*/
+type Batcher struct {
+	sync.Mutex
+	dsn           string
+	flushRows     int
+	flushInterval time.Duration
+	conn          clickhouse.Clickhouse
+	pending       []LogEntry
+	waiters       []chan error
+	trigger       chan struct{}
+	done          chan struct{}
+	stopped       chan struct{}
+	isClosed      bool
+}
+
+func CreateBatcher(dsn string, flushRows int, flushInterval time.Duration) (*Batcher, error) {
+	if flushRows <= 0 {
+		return nil, errors.New("number of rows per flush must larger than zero")
+	}
+	if flushInterval <= 0 {
+		return nil, errors.New("flush interval must larger than zero")
+	}
+	b := &Batcher{
+		dsn:           dsn,
+		flushRows:     flushRows,
+		flushInterval: flushInterval,
+		trigger:       make(chan struct{}, 1),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	go b.scheduleToFlush()
+	return b, nil
+}
+
+func (b *Batcher) Add(entries []LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	result := make(chan error, 1)
+	b.Lock()
+	if b.isClosed {
+		b.Unlock()
+		return errBatcherClosed
+	}
+	b.pending = append(b.pending, entries...)
+	b.waiters = append(b.waiters, result)
+	full := len(b.pending) >= b.flushRows
+	b.Unlock()
+
+	if full {
+		select {
+		case b.trigger <- struct{}{}:
+		default:
+		}
+	}
+	return <-result
+}
+
+func (b *Batcher) scheduleToFlush() {
+	t := time.NewTicker(b.flushInterval)
+	defer func() {
+		t.Stop()
+		close(b.stopped)
+	}()
+	for {
+		select {
+		case <-t.C:
+			break
+		case <-b.trigger:
+			break
+		case <-b.done:
+			b.flush()
+			return
+		}
+		b.flush()
+	}
+}
+
+func (b *Batcher) flush() {
+	b.Lock()
+	entries, waiters := b.pending, b.waiters
+	b.pending, b.waiters = nil, nil
+	b.Unlock()
+	if len(entries) == 0 {
+		return
+	}
+
+	err := b.write(entries)
+	if err != nil {
+		log.Printf("flush %d log entries to click-house get error %v\n", len(entries), err)
+	}
+	for _, w := range waiters {
+		w <- err
+	}
+}
+
+func (b *Batcher) write(entries []LogEntry) error {
+	if b.conn == nil {
+		conn, err := clickhouse.OpenDirect(b.dsn)
+		if err != nil {
+			return fmt.Errorf("can not connect to click-house db %v", err)
+		}
+		b.conn = conn
+	}
+
+	err := b.writeBlock(entries)
+	if err != nil {
+		/** the connection is in unknown state, open a new one next time */
+		_ = b.conn.Close()
+		b.conn = nil
+	}
+	return err
+}
+
+func (b *Batcher) writeBlock(entries []LogEntry) error {
+	if _, err := b.conn.Begin(); err != nil {
+		return fmt.Errorf("open click-house tx get error %v", err)
+	}
+	if _, err := b.conn.Prepare(insertScript()); err != nil {
+		_ = b.conn.Rollback()
+		return fmt.Errorf("prepare click-house statement get error %v", err)
+	}
+	block, err := b.conn.Block()
+	if err != nil {
+		_ = b.conn.Rollback()
+		return err
+	}
+
+	block.Reserve()
+	block.NumRows += uint64(len(entries))
+	for _, e := range entries {
+		for _, err := range []error{
+			block.WriteInt64(0, e.Id),
+			block.WriteString(1, e.Tag),
+			block.WriteInt64(2, e.Timestamp),
+			block.WriteString(3, ToYYYYMMDD(e.Timestamp)),
+			block.WriteString(4, e.ContainerName),
+			block.WriteInt32(5, e.Level),
+			block.WriteString(6, e.Message),
+			block.WriteArray(7, e.ContextKeys),
+			block.WriteArray(8, e.ContextValues),
+			block.WriteString(9, e.EventId),
+		} {
+			if err != nil {
+				_ = b.conn.Rollback()
+				return fmt.Errorf("write click-house block get error %v", err)
+			}
+		}
+	}
+
+	if err := b.conn.Commit(); err != nil {
+		return fmt.Errorf("commit log to click-house db get error %v", err)
+	}
+	return nil
+}
+
+/**
+Close flushes the pending entries and closes the connection.
+*/
+func (b *Batcher) Close() error {
+	b.Lock()
+	if b.isClosed {
+		b.Unlock()
+		return nil
+	}
+	b.isClosed = true
+	b.Unlock()
+
+	close(b.done)
+	<-b.stopped
+	if b.conn != nil {
+		return b.conn.Close()
+	}
+	return nil
+}
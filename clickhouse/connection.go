@@ -3,11 +3,11 @@ package clickhouse
 import (
 	"context"
 	"database/sql"
-	"errors"
 	"fmt"
 	. "hermes/core"
 	"log"
 	"net/http"
+	"strconv"
 )
 
 type Connection struct {
@@ -23,7 +23,7 @@ func (c *Connection) Close() error {
 }
 
 func (c *Connection) GetAllTags(ctx context.Context) ([]string, error) {
-	selectScript := fmt.Sprintf(`SELECT DISTINCT(tag) FROM %s.%s`, DatabaseName, LogTableName)
+	selectScript := fmt.Sprintf(`SELECT DISTINCT(tag) FROM %s.%s ORDER BY tag`, DatabaseName, CatalogTableName)
 	log.Println(`query:`, selectScript)
 	rows, err := c.conn.QueryContext(ctx, selectScript)
 	if err != nil {
@@ -48,151 +48,463 @@ func (c *Connection) GetAllTags(ctx context.Context) ([]string, error) {
 	return list, nil
 }
 
-//id, tag, timestamp, date, container_name, level, message, context.key, context.value
-var logQueryScript = `SELECT id, tag, timestamp, date, container_name, level, message, context.key, context.value
- FROM %s.%s
- WHERE tag = ? AND level >= ? AND (timestamp >= ? AND timestamp <= ?)
- ORDER BY timestamp ASC
-`
+/**
+GetCatalog reads the tag catalog maintained by a materialized view, it never
+scans the logs table.
+*/
+func (c *Connection) GetCatalog(ctx context.Context, days int) ([]TagInfo, error) {
+	selectScript := buildCatalogQuery()
+	log.Println(`query:`, selectScript)
+	rows, err := c.conn.QueryContext(ctx, selectScript)
+	if err != nil {
+		return nil, err
+	}
 
-func (c *Connection) GetLog(ctx context.Context, opt QueryLogOption) error {
-	selectScript := fmt.Sprintf(logQueryScript, DatabaseName, LogTableName)
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	list := make([]TagInfo, 0)
+	index := make(map[string]int)
+	for rows.Next() {
+		var v TagInfo
+		var levels []int32
+		var counts []uint64
+		if err := rows.Scan(&v.Tag, &v.FirstSeen, &v.LastSeen, &v.Count, &levels, &counts, &v.ContextKeys); err != nil {
+			return nil, err
+		}
+		v.Levels = make(map[string]uint64, len(levels))
+		for i, level := range levels {
+			v.Levels[LogLevelStr(level)] += counts[i]
+		}
+		index[v.Tag] = len(list)
+		list = append(list, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if days <= 0 {
+		return list, nil
+	}
+
+	selectScript, args := buildVolumeQuery(days)
+	log.Println(`query:`, selectScript)
+	volumes, err := c.conn.QueryContext(ctx, selectScript, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = volumes.Close()
+	}()
+
+	for volumes.Next() {
+		var tag string
+		var v DayVolume
+		if err := volumes.Scan(&tag, &v.Day, &v.Count); err != nil {
+			return nil, err
+		}
+		if i, ok := index[tag]; ok {
+			list[i].Volume = append(list[i].Volume, v)
+		}
+	}
+	if err := volumes.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (c *Connection) GetContainers(ctx context.Context, opt QueryLogOption) ([]ContainerCount, error) {
+	selectScript, args := buildContainerQuery(opt)
 	log.Println(`query:`, selectScript)
-	rows, err := c.conn.QueryContext(ctx, selectScript, opt.Tag, opt.LogLevel, opt.StartTime, opt.EndTime)
+	rows, err := c.conn.QueryContext(ctx, selectScript, args...)
 	if err != nil {
-		opt.Response <- OutputLogMessage{
-			OutputMessage: OutputMessage{
-				Code:    http.StatusInternalServerError,
-				Message: err.Error(),
-			},
+		return nil, err
+	}
+
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	list := make([]ContainerCount, 0)
+	for rows.Next() {
+		var v ContainerCount
+		if err := rows.Scan(&v.Name, &v.Count); err != nil {
+			return nil, err
 		}
-		return err
+		list = append(list, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (c *Connection) GetContextKeys(ctx context.Context, opt ContextOption) ([]StatsGroup, error) {
+	selectScript, args := buildContextKeyQuery(opt)
+	return c.getGroups(ctx, selectScript, args)
+}
+
+func (c *Connection) GetContextValues(ctx context.Context, opt ContextOption) ([]StatsGroup, error) {
+	selectScript, args := buildContextValueQuery(opt)
+	return c.getGroups(ctx, selectScript, args)
+}
+
+func (c *Connection) getGroups(ctx context.Context, selectScript string, args []interface{}) ([]StatsGroup, error) {
+	log.Println(`query:`, selectScript)
+	rows, err := c.conn.QueryContext(ctx, selectScript, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	list := make([]StatsGroup, 0)
+	for rows.Next() {
+		var v StatsGroup
+		if err := rows.Scan(&v.Value, &v.Count); err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (c *Connection) GetHistogram(ctx context.Context, opt HistogramOption) ([]HistogramBucket, error) {
+	selectScript, args := buildHistogramQuery(opt)
+	log.Println(`query:`, selectScript)
+	rows, err := c.conn.QueryContext(ctx, selectScript, args...)
+	if err != nil {
+		return nil, err
 	}
 
 	defer func() {
 		_ = rows.Close()
 	}()
 
-	list := make([]OutputLogPayload, opt.BatchSize)
-	i := int32(0)
-	totalMessage := 0
+	list := make([]HistogramBucket, 0)
 	for rows.Next() {
-		totalMessage++
 		var (
-			id            int64
-			tag           string
-			timestamp     int64
-			date          string
-			containerName string
-			level         int32
-			message       string
-			contextKeys   []string
-			contextValues []string
+			v     HistogramBucket
+			level int32
 		)
-		if err := rows.Scan(&id, &tag,
-			&timestamp, &date, &containerName,
-			&level, &message,
-			&contextKeys, &contextValues); err != nil {
-			opt.Response <- OutputLogMessage{
-				OutputMessage: OutputMessage{
-					Code:    http.StatusInternalServerError,
-					Message: err.Error(),
-				},
-			}
-			return err
+		if err := rows.Scan(&v.Timestamp, &level, &v.Group, &v.Count); err != nil {
+			return nil, err
 		}
+		v.Level = LogLevelStr(level)
+		list = append(list, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (c *Connection) GetStats(ctx context.Context, opt StatsOption) (LogStats, error) {
+	stats := LogStats{}
+	countScript, args := buildCountQuery(opt)
+	log.Println(`query:`, countScript)
+	err := c.conn.QueryRowContext(ctx, countScript, args...).Scan(&stats.Count, &stats.Distinct)
+	if err != nil {
+		return stats, err
+	}
+	if opt.Top <= 0 {
+		return stats, nil
+	}
+
+	topScript, args := buildTopQuery(opt)
+	log.Println(`query:`, topScript)
+	rows, err := c.conn.QueryContext(ctx, topScript, args...)
+	if err != nil {
+		return stats, err
+	}
 
-		ctx := make(InputLogContext)
-		if len(contextKeys) > 0 {
-			for i, v := range contextKeys {
-				ctx[v] = contextValues[i]
-			}
-		}
-
-		list[i] = OutputLogPayload{
-			Id:    id,
-			IdStr: fmt.Sprintf("%d", id),
-			Date:  date,
-			InputLogPayload: InputLogPayload{
-				Tag:           opt.Tag,
-				Timestamp:     timestamp,
-				ContainerName: containerName,
-				Level:         LogLevelStr(level),
-				Message:       message,
-				Context:       ctx,
-			},
-		}
-		i++
-		if i == opt.BatchSize {
-			i = 0
-			opt.Response <- OutputLogMessage{
-				OutputMessage: OutputMessage{
-					Code:    http.StatusOK,
-					Message: "OK",
-				},
-				Data: list,
-			}
-		}
-	}
-	if i > 0 {
-		opt.Response <- OutputLogMessage{
-			OutputMessage: OutputMessage{
-				Code:    http.StatusOK,
-				Message: "OK",
-			},
-			Data: list[0:i],
-		}
-	}
-	log.Printf("Found %d log messages\n", totalMessage)
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	stats.Top = make([]StatsGroup, 0, opt.Top)
+	for rows.Next() {
+		var v StatsGroup
+		if err := rows.Scan(&v.Value, &v.Count); err != nil {
+			return stats, err
+		}
+		if opt.Field == FieldLevel {
+			level, _ := strconv.Atoi(v.Value)
+			v.Value = LogLevelStr(int32(level))
+		}
+		stats.Top = append(stats.Top, v)
+	}
+	return stats, rows.Err()
+}
+
+/**
+GetEntry looks for the log within the window of its id time first, then in
+the whole table for the logs collected long after they were written.
+*/
+func (c *Connection) GetEntry(ctx context.Context, id int64, tag string) (OutputLogPayload, error) {
+	for _, narrow := range []bool{true, false} {
+		selectScript, args := buildLookupQuery(id, tag, narrow)
+		log.Println(`query:`, selectScript)
+		rows, err := c.conn.QueryContext(ctx, selectScript, args...)
+		if err != nil {
+			return OutputLogPayload{}, err
+		}
+		found := rows.Next()
+		var v OutputLogPayload
+		if found {
+			v, err = scanLogRow(rows)
+		} else {
+			err = rows.Err()
+		}
+		_ = rows.Close()
+		if err != nil || found {
+			return v, err
+		}
+	}
+	return OutputLogPayload{}, ErrLogNotFound
+}
+
+func (c *Connection) GetSurrounding(ctx context.Context, opt SurroundingOption) ([]OutputLogPayload, error) {
+	entry, err := c.GetEntry(ctx, opt.Id, opt.Tag)
+	if err != nil {
+		return nil, err
+	}
+
+	before, err := c.getRows(ctx, entry, opt.Before, true)
+	if err != nil {
+		return nil, err
+	}
+	after, err := c.getRows(ctx, entry, opt.After+1, false)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]OutputLogPayload, 0, len(before)+len(after))
+	for i := len(before) - 1; i >= 0; i-- {
+		list = append(list, before[i])
+	}
+	return append(list, after...), nil
+}
+
+func (c *Connection) getRows(ctx context.Context, entry OutputLogPayload, limit int32, before bool) ([]OutputLogPayload, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	selectScript, args := buildSurroundingQuery(entry, limit, before)
+	log.Println(`query:`, selectScript)
+	rows, err := c.conn.QueryContext(ctx, selectScript, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	list := make([]OutputLogPayload, 0, limit)
+	for rows.Next() {
+		v, err := scanLogRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
 	if err := rows.Err(); err != nil {
-		opt.Response <- OutputLogMessage{
-			OutputMessage: OutputMessage{
-				Code:    http.StatusInternalServerError,
-				Message: err.Error(),
-			},
+		return nil, err
+	}
+	return list, nil
+}
+
+/**
+lookupTimestamp finds the timestamp of the row of id like GetEntry does, within
+the window of the id time first.
+*/
+func (c *Connection) lookupTimestamp(ctx context.Context, tag string, id int64) (int64, error) {
+	entry, err := c.GetEntry(ctx, id, tag)
+	if err == ErrLogNotFound {
+		return 0, fmt.Errorf("not found log with id %d", id)
+	}
+	return entry.Timestamp, err
+}
+
+func scanLogRow(rows *sql.Rows) (OutputLogPayload, error) {
+	var (
+		id            int64
+		tag           string
+		timestamp     int64
+		date          string
+		containerName string
+		level         int32
+		message       string
+		contextKeys   []string
+		contextValues []string
+		eventId       string
+	)
+	if err := rows.Scan(&id, &tag,
+		&timestamp, &date, &containerName,
+		&level, &message,
+		&contextKeys, &contextValues, &eventId); err != nil {
+		return OutputLogPayload{}, err
+	}
+
+	ctx := make(InputLogContext)
+	if len(contextKeys) > 0 {
+		for i, v := range contextKeys {
+			ctx[v] = contextValues[i]
 		}
-		return err
 	}
-	opt.Response <- OutputLogMessage{
+
+	/** event_id holds the id when the client gave none */
+	if eventId == strconv.FormatInt(id, 10) {
+		eventId = ""
+	}
+
+	return OutputLogPayload{
+		Id:    id,
+		IdStr: fmt.Sprintf("%d", id),
+		Date:  date,
+		InputLogPayload: InputLogPayload{
+			Tag:           tag,
+			Timestamp:     timestamp,
+			ContainerName: containerName,
+			Level:         LogLevelStr(level),
+			Message:       message,
+			Context:       ctx,
+			EventId:       eventId,
+		},
+	}, nil
+}
+
+func errorLogMessage(err error) OutputLogMessage {
+	return OutputLogMessage{
 		OutputMessage: OutputMessage{
-			Code:    http.StatusNoContent,
-			Message: "OK",
+			Code:    http.StatusInternalServerError,
+			Message: err.Error(),
 		},
 	}
-	return nil
 }
 
-func (c *Connection) Insert(logs []LogEntry) error {
-	tx, err := c.conn.Begin()
-	if err != nil {
-		return errors.New(fmt.Sprintf("open click-house tx get error %v", err))
+func (c *Connection) GetLog(ctx context.Context, opt QueryLogOption) error {
+	if opt.LastId > 0 && opt.LastTimestamp == 0 {
+		timestamp, err := c.lookupTimestamp(ctx, opt.Tag, opt.LastId)
+		if err != nil {
+			opt.Response <- errorLogMessage(err)
+			return err
+		}
+		opt.LastTimestamp = timestamp
 	}
-	insertScript := fmt.Sprintf(`INSERT INTO %s.%s(id, tag, timestamp, date, container_name, level, message, context.key, context.value) VALUES (?,?,?,?,?,?,?,?,?)`, DatabaseName, LogTableName)
-	stmt, err := tx.Prepare(insertScript)
+
+	selectScript, args := buildLogQuery(opt)
+	log.Println(`query:`, selectScript)
+	rows, err := c.conn.QueryContext(ctx, selectScript, args...)
 	if err != nil {
-		return errors.New(fmt.Sprintf("prepare click-house statement get error %v", err))
+		opt.Response <- errorLogMessage(err)
+		return err
 	}
+
 	defer func() {
-		_ = stmt.Close()
+		_ = rows.Close()
 	}()
-	for _, logEntry := range logs {
-		_, err := stmt.Exec(
-			NextId(),
-			logEntry.Tag,
-			logEntry.Timestamp,
-			ToYYYYMMDD(logEntry.Timestamp),
-			logEntry.ContainerName,
-			logEntry.Level,
-			logEntry.Message,
-			logEntry.ContextKeys,
-			logEntry.ContextValues,
-		)
+
+	page := &logPage{opt: opt}
+	for rows.Next() {
+		payload, err := scanLogRow(rows)
 		if err != nil {
-			log.Println(err)
+			opt.Response <- errorLogMessage(err)
+			return err
 		}
+		page.add(payload)
 	}
-	if err := tx.Commit(); err != nil {
-		return errors.New(fmt.Sprintf("commit log to click-house db get error %v", err))
+	if err := rows.Err(); err != nil {
+		opt.Response <- errorLogMessage(err)
+		return err
 	}
+	page.finish()
+	log.Printf("Found %d log messages\n", page.total)
 	return nil
 }
+
+/**
+logPage sends rows to the response channel in batches of BatchSize, stops at
+Limit and ends with a message holding the cursor of the page. Rows of a
+backward page arrive in reverse, so they are held until the end.
+*/
+type logPage struct {
+	opt      QueryLogOption
+	batch    []OutputLogPayload
+	buffered []OutputLogPayload
+	total    int32
+	hasMore  bool
+	first    *OutputLogPayload
+	last     *OutputLogPayload
+}
+
+func (p *logPage) add(v OutputLogPayload) {
+	if p.opt.Limit > 0 && p.total == p.opt.Limit {
+		p.hasMore = true
+		return
+	}
+	p.total++
+	if p.opt.Backward {
+		p.buffered = append(p.buffered, v)
+		return
+	}
+	p.emit(v)
+}
+
+func (p *logPage) emit(v OutputLogPayload) {
+	if p.first == nil {
+		p.first = &v
+	}
+	p.last = &v
+	p.batch = append(p.batch, v)
+	if int32(len(p.batch)) >= p.opt.BatchSize {
+		p.flush()
+	}
+}
+
+func (p *logPage) flush() {
+	if len(p.batch) == 0 {
+		return
+	}
+	p.opt.Response <- OutputLogMessage{
+		OutputMessage: OutputMessage{
+			Code:    http.StatusOK,
+			Message: "OK",
+		},
+		Data: p.batch,
+	}
+	p.batch = nil
+}
+
+func (p *logPage) finish() {
+	for i := len(p.buffered) - 1; i >= 0; i-- {
+		p.emit(p.buffered[i])
+	}
+	p.flush()
+
+	cursor := &PageCursor{HasMore: p.hasMore}
+	if p.first != nil {
+		cursor.FirstId = p.first.IdStr
+		cursor.FirstTimestamp = p.first.Timestamp
+		cursor.LastId = p.last.IdStr
+		cursor.LastTimestamp = p.last.Timestamp
+	}
+	p.opt.Response <- OutputLogMessage{
+		OutputMessage: OutputMessage{
+			Code:    http.StatusNoContent,
+			Message: "OK",
+		},
+		Cursor: cursor,
+	}
+}
+
+func insertScript() string {
+	return fmt.Sprintf(`INSERT INTO %s.%s(id, tag, timestamp, date, container_name, level, message, context.key, context.value, event_id) VALUES (?,?,?,?,?,?,?,?,?,?)`, DatabaseName, LogTableName)
+}
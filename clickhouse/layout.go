@@ -0,0 +1,65 @@
+package clickhouse
+
+import (
+	"database/sql"
+	"fmt"
+	. "hermes/core"
+	"log"
+	"time"
+)
+
+const IdLayoutTableName = "id_layout"
+
+/**
+CheckIdLayout compares the layout with the one recorded with the first
+stored logs. When none is recorded yet, the stored ids must decode to a time
+that is not in the future, otherwise the new ids would sort before them.
+*/
+func (c *Connection) CheckIdLayout(layout IdConfig) error {
+	var recorded IdConfig
+	row := c.conn.QueryRow(fmt.Sprintf(`SELECT epoch, node_bits, step_bits FROM %s.%s ORDER BY applied_at DESC LIMIT 1`,
+		DatabaseName, IdLayoutTableName))
+	err := row.Scan(&recorded.Epoch, &recorded.NodeBits, &recorded.StepBits)
+	if err == nil {
+		if recorded.Epoch != layout.Epoch || recorded.NodeBits != layout.NodeBits || recorded.StepBits != layout.StepBits {
+			return fmt.Errorf("id layout (epoch %d, node_bits %d, step_bits %d) does not match the layout "+
+				"(epoch %d, node_bits %d, step_bits %d) of stored logs", layout.Epoch, layout.NodeBits, layout.StepBits,
+				recorded.Epoch, recorded.NodeBits, recorded.StepBits)
+		}
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return fmt.Errorf("read id layout of click-house get error %v", err)
+	}
+
+	var maxId int64
+	selectScript := fmt.Sprintf(`SELECT max(id) FROM %s.%s`, DatabaseName, LogTableName)
+	log.Println(`query:`, selectScript)
+	if err := c.conn.QueryRow(selectScript).Scan(&maxId); err != nil {
+		return fmt.Errorf("read last id of click-house get error %v", err)
+	}
+	latest := time.Now().Add(time.Minute).UnixNano() / int64(time.Millisecond)
+	if t := (maxId >> (layout.NodeBits + layout.StepBits)) + layout.Epoch; maxId > 0 && t > latest {
+		return fmt.Errorf("id layout (epoch %d, node_bits %d, step_bits %d) decodes stored id %d to the future",
+			layout.Epoch, layout.NodeBits, layout.StepBits, maxId)
+	}
+
+	tx, err := c.conn.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(fmt.Sprintf(`INSERT INTO %s.%s (epoch, node_bits, step_bits, applied_at) VALUES (?, ?, ?, ?)`,
+		DatabaseName, IdLayoutTableName))
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	defer func() {
+		_ = stmt.Close()
+	}()
+	if _, err := stmt.Exec(layout.Epoch, layout.NodeBits, layout.StepBits, time.Now()); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
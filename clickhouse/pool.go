@@ -10,15 +10,11 @@ import (
 	"time"
 )
 
-/**
-┌─────id──────┬─tag─┬──timestamp──┬───date───┬─container name──┬──level─┬─message─────────────┬─context.key───┬─context.value────┐
-│ 1234567890  │ app │ 12345678901 │ 20200507 │    container    │  info  │ This is log message │ ['a','b','c'] │ ['v1','v2','v3'] │
-└─────────────┴─────┴─────────────┴──────────┴─────────────────┴────────┴─────────────────────┴───────────────┴──────────────────┘
- */
-
 const (
 	DatabaseName = "hermes"
 	LogTableName = "logs"
+
+	CatalogTableName = "tag_catalog"
 )
 
 var (
@@ -0,0 +1,342 @@
+package clickhouse
+
+import (
+	"fmt"
+	. "hermes/core"
+	"strings"
+	"time"
+)
+
+/**
+logFilter collects the WHERE conditions of a query along with their arguments.
+*/
+type logFilter struct {
+	conditions []string
+	args       []interface{}
+}
+
+func (f *logFilter) add(condition string, args ...interface{}) {
+	f.conditions = append(f.conditions, condition)
+	f.args = append(f.args, args...)
+}
+
+func (f *logFilter) where() string {
+	if len(f.conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(f.conditions, " AND ")
+}
+
+func newLogFilter(opt QueryLogOption) *logFilter {
+	f := &logFilter{}
+	if opt.Tag != "" {
+		f.add("tag = ?", opt.Tag)
+	}
+	f.add("level >= ?", opt.LogLevel)
+	f.add("(timestamp >= ? AND timestamp <= ?)", opt.StartTime, opt.EndTime)
+	for _, m := range opt.Message {
+		f.addMessage(m)
+	}
+	for _, c := range opt.Context {
+		f.addContext(c)
+	}
+	f.addContainers(opt.Containers, opt.ExcludeContainers)
+	return f
+}
+
+func (f *logFilter) addContainers(include []string, exclude []string) {
+	if len(include) > 0 {
+		conditions := make([]string, len(include))
+		args := make([]interface{}, len(include))
+		for i, v := range include {
+			conditions[i] = "container_name LIKE ?"
+			args[i] = globToLike(v)
+		}
+		f.add("("+strings.Join(conditions, " OR ")+")", args...)
+	}
+	for _, v := range exclude {
+		f.add("container_name NOT LIKE ?", globToLike(v))
+	}
+}
+
+/**
+globToLike turns * and ? of a glob into the wildcards of LIKE.
+*/
+func globToLike(glob string) string {
+	return strings.NewReplacer("*", "%", "?", "_").Replace(escapeLike(glob))
+}
+
+/**
+addContext looks the key up in the context.key array and compares the value
+at the same index of context.value.
+*/
+func (f *logFilter) addContext(c ContextFilter) {
+	value := "context.value[indexOf(context.key, ?)]"
+	switch c.Op {
+	case ContextExists:
+		f.add("has(context.key, ?)", c.Key)
+		break
+	case ContextNotEquals:
+		f.add(fmt.Sprintf("NOT (has(context.key, ?) AND %s = ?)", value), c.Key, c.Key, c.Value)
+		break
+	case ContextIn:
+		args := []interface{}{c.Key, c.Key}
+		placeholders := make([]string, len(c.Values))
+		for i, v := range c.Values {
+			placeholders[i] = "?"
+			args = append(args, v)
+		}
+		f.add(fmt.Sprintf("(has(context.key, ?) AND %s IN (%s))", value, strings.Join(placeholders, ", ")), args...)
+		break
+	case ContextPrefix:
+		f.add(fmt.Sprintf("(has(context.key, ?) AND startsWith(%s, ?))", value), c.Key, c.Key, c.Value)
+		break
+	default:
+		f.add(fmt.Sprintf("(has(context.key, ?) AND %s = ?)", value), c.Key, c.Key, c.Value)
+		break
+	}
+}
+
+/**
+addMessage uses functions that the skip indexes of message support where
+possible: LIKE for ngrambf_v1 and hasToken for tokenbf_v1.
+*/
+func (f *logFilter) addMessage(m MessageFilter) {
+	var condition string
+	var arg interface{}
+	switch m.Mode {
+	case MatchToken:
+		condition, arg = "hasToken(message, ?)", m.Pattern
+		if m.CaseInsensitive {
+			condition, arg = "hasToken(lower(message), ?)", strings.ToLower(m.Pattern)
+		}
+		break
+	case MatchRegex:
+		condition, arg = "match(message, ?)", m.Pattern
+		if m.CaseInsensitive {
+			arg = "(?i)" + m.Pattern
+		}
+		break
+	default:
+		condition, arg = "message LIKE ?", "%"+escapeLike(m.Pattern)+"%"
+		if m.CaseInsensitive {
+			condition, arg = "positionCaseInsensitiveUTF8(message, ?) > 0", m.Pattern
+		}
+		break
+	}
+	if m.Negate {
+		condition = "NOT " + condition
+	}
+	f.add(condition, arg)
+}
+
+func escapeLike(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `%`, `\%`, -1)
+	return strings.Replace(s, `_`, `\_`, -1)
+}
+
+/**
+scanDescending tells whether the rows are read from the newest one. A backward
+page is read in the opposite order of the one it is shown in.
+*/
+func scanDescending(opt QueryLogOption) bool {
+	return opt.Descending != opt.Backward
+}
+
+/** columns read by scanLogRow */
+const logColumns = "id, tag, timestamp, date, container_name, level, message, context.key, context.value, event_id"
+
+/**
+buildLogQuery reads the logs with FINAL like the other queries of the logs
+table. The ReplacingMergeTree merges the rows of an event id sent twice in the
+background only, FINAL deduplicates the ones that are not merged yet.
+*/
+func buildLogQuery(opt QueryLogOption) (string, []interface{}) {
+	f := newLogFilter(opt)
+
+	direction := "ASC"
+	if scanDescending(opt) {
+		direction = "DESC"
+	}
+	if opt.LastId > 0 {
+		if scanDescending(opt) {
+			f.add("(timestamp < ? OR (timestamp = ? AND id < ?))", opt.LastTimestamp, opt.LastTimestamp, opt.LastId)
+		} else {
+			f.add("(timestamp > ? OR (timestamp = ? AND id > ?))", opt.LastTimestamp, opt.LastTimestamp, opt.LastId)
+		}
+	}
+
+	script := fmt.Sprintf(`SELECT %s
+ FROM %s.%s FINAL%s
+ ORDER BY timestamp %s, id %s`, logColumns, DatabaseName, LogTableName, f.where(), direction, direction)
+	if opt.Limit > 0 {
+		/** one more row tells whether there is a next page */
+		script = fmt.Sprintf("%s\n LIMIT %d", script, opt.Limit+1)
+	}
+	return script, f.args
+}
+
+func buildContainerQuery(opt QueryLogOption) (string, []interface{}) {
+	f := newLogFilter(opt)
+	return fmt.Sprintf(`SELECT container_name, count() AS total
+ FROM %s.%s FINAL%s
+ GROUP BY container_name
+ ORDER BY total DESC, container_name ASC`, DatabaseName, LogTableName, f.where()), f.args
+}
+
+/**
+groupExpression is the column a histogram or a statistic is split by.
+*/
+func groupExpression(groupBy string, contextKey string) (string, []interface{}) {
+	switch groupBy {
+	case GroupByContainer:
+		return "container_name", nil
+	case GroupByContext:
+		return "context.value[indexOf(context.key, ?)]", []interface{}{contextKey}
+	}
+	return "''", nil
+}
+
+func buildHistogramQuery(opt HistogramOption) (string, []interface{}) {
+	f := newLogFilter(opt.QueryLogOption)
+	group, args := groupExpression(opt.GroupBy, opt.ContextKey)
+	return fmt.Sprintf(`SELECT intDiv(timestamp, %[1]d) * %[1]d AS bucket, level, %[2]s AS grp, count() AS total
+ FROM %[3]s.%[4]s FINAL%[5]s
+ GROUP BY bucket, level, grp
+ ORDER BY bucket ASC, level ASC, grp ASC`, opt.Interval, group, DatabaseName, LogTableName, f.where()), append(args, f.args...)
+}
+
+func fieldExpression(field string, contextKey string) (string, []interface{}) {
+	switch field {
+	case FieldTag:
+		return "tag", nil
+	case FieldLevel:
+		return "toString(level)", nil
+	case FieldMessage:
+		return "message", nil
+	case FieldContext:
+		return groupExpression(GroupByContext, contextKey)
+	}
+	return groupExpression(GroupByContainer, "")
+}
+
+func statsFilter(opt StatsOption) *logFilter {
+	f := newLogFilter(opt.QueryLogOption)
+	if opt.Field == FieldContext {
+		f.add("has(context.key, ?)", opt.ContextKey)
+	}
+	return f
+}
+
+func buildCountQuery(opt StatsOption) (string, []interface{}) {
+	f := statsFilter(opt)
+	field, args := fieldExpression(opt.Field, opt.ContextKey)
+	return fmt.Sprintf(`SELECT count(), uniq(%s)
+ FROM %s.%s FINAL%s`, field, DatabaseName, LogTableName, f.where()), append(args, f.args...)
+}
+
+func buildTopQuery(opt StatsOption) (string, []interface{}) {
+	f := statsFilter(opt)
+	field, args := fieldExpression(opt.Field, opt.ContextKey)
+	return fmt.Sprintf(`SELECT %s AS value, count() AS total
+ FROM %s.%s FINAL%s
+ GROUP BY value
+ ORDER BY total DESC, value ASC
+ LIMIT %d`, field, DatabaseName, LogTableName, f.where(), opt.Top), append(args, f.args...)
+}
+
+func buildCatalogQuery() string {
+	return fmt.Sprintf(`SELECT tag, minMerge(first_seen), maxMerge(last_seen), countMerge(total),
+ tupleElement(sumMapMerge(levels) AS level_map, 1), tupleElement(level_map, 2),
+ groupUniqArrayArrayMerge(context_keys)
+ FROM %s.%s
+ GROUP BY tag
+ ORDER BY tag ASC`, DatabaseName, CatalogTableName)
+}
+
+func buildVolumeQuery(days int) (string, []interface{}) {
+	return fmt.Sprintf(`SELECT tag, toString(day), countMerge(total)
+ FROM %s.%s
+ WHERE day > today() - ?
+ GROUP BY tag, day
+ ORDER BY tag ASC, day ASC`, DatabaseName, CatalogTableName), []interface{}{days}
+}
+
+func buildContextKeyQuery(opt ContextOption) (string, []interface{}) {
+	f := newLogFilter(opt.QueryLogOption)
+	if opt.Prefix != "" {
+		f.add("key LIKE ?", escapeLike(opt.Prefix)+"%")
+	}
+	return fmt.Sprintf(`SELECT key, count() AS total
+ FROM %s.%s FINAL
+ ARRAY JOIN context.key AS key%s
+ GROUP BY key
+ ORDER BY total DESC, key ASC
+ LIMIT %d`, DatabaseName, LogTableName, f.where(), opt.Top), f.args
+}
+
+func buildContextValueQuery(opt ContextOption) (string, []interface{}) {
+	f := newLogFilter(opt.QueryLogOption)
+	f.add("has(context.key, ?)", opt.Key)
+	field, args := groupExpression(GroupByContext, opt.Key)
+	if opt.Prefix != "" {
+		f.add(field+" LIKE ?", append(args, escapeLike(opt.Prefix)+"%")...)
+	}
+	return fmt.Sprintf(`SELECT %s AS value, count() AS total
+ FROM %s.%s FINAL%s
+ GROUP BY value
+ ORDER BY total DESC, value ASC
+ LIMIT %d`, field, DatabaseName, LogTableName, f.where(), opt.Top), append(args, f.args...)
+}
+
+/**
+The id of a log is generated when it is collected, so its timestamp is
+expected within this window around the time of the id. The window lets
+ClickHouse skip the other partitions.
+*/
+const (
+	idLookBehind = int64(time.Hour / time.Millisecond)
+	idLookAhead  = int64(5 * time.Minute / time.Millisecond)
+)
+
+/**
+buildLookupQuery selects the row of id, within the window of the id time when
+narrow is set.
+*/
+func buildLookupQuery(id int64, tag string, narrow bool) (string, []interface{}) {
+	f := &logFilter{}
+	if tag != "" {
+		f.add("tag = ?", tag)
+	}
+	if narrow {
+		t := ParseInt64(id).Time()
+		f.add("timestamp >= ?", t-idLookBehind)
+		f.add("timestamp <= ?", t+idLookAhead)
+	}
+	f.add("id = ?", id)
+	return fmt.Sprintf(`SELECT %s
+ FROM %s.%s FINAL%s
+ LIMIT 1`, logColumns, DatabaseName, LogTableName, f.where()), f.args
+}
+
+/**
+buildSurroundingQuery selects the rows of the tag and container of entry
+before its keyset, or after it with the entry itself.
+*/
+func buildSurroundingQuery(entry OutputLogPayload, limit int32, before bool) (string, []interface{}) {
+	f := &logFilter{}
+	f.add("tag = ?", entry.Tag)
+	f.add("container_name = ?", entry.ContainerName)
+	direction := "ASC"
+	if before {
+		direction = "DESC"
+		f.add("(timestamp < ? OR (timestamp = ? AND id < ?))", entry.Timestamp, entry.Timestamp, entry.Id)
+	} else {
+		f.add("(timestamp > ? OR (timestamp = ? AND id >= ?))", entry.Timestamp, entry.Timestamp, entry.Id)
+	}
+	return fmt.Sprintf(`SELECT %s
+ FROM %s.%s FINAL%s
+ ORDER BY timestamp %s, id %s
+ LIMIT %d`, logColumns, DatabaseName, LogTableName, f.where(), direction, direction, limit), f.args
+}
@@ -0,0 +1,65 @@
+package clickhouse
+
+import (
+	. "hermes/core"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuildLookupQuery(t *testing.T) {
+	node, err := NewNode(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := node.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query, args := buildLookupQuery(id.Int64(), "web", true)
+	if !strings.Contains(query, "WHERE tag = ? AND timestamp >= ? AND timestamp <= ? AND id = ?") {
+		t.Fatalf("expected lookup to be narrowed by the id time, got %s", query)
+	}
+	expected := []interface{}{"web", id.Time() - idLookBehind, id.Time() + idLookAhead, id.Int64()}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("unexpected arguments %v, expected %v", args, expected)
+	}
+
+	query, args = buildLookupQuery(id.Int64(), "", false)
+	if !strings.Contains(query, "WHERE id = ?") || len(args) != 1 {
+		t.Fatalf("expected lookup of the whole table, got %s %v", query, args)
+	}
+}
+
+func TestGlobToLike(t *testing.T) {
+	for glob, expected := range map[string]string{
+		"api-*":     "api-%",
+		"worker-?":  "worker-_",
+		"50%_off*":  `50\%\_off%`,
+		`c:\logs\*`: `c:\\logs\\%`,
+	} {
+		if like := globToLike(glob); like != expected {
+			t.Errorf("glob %s is turned into %s, expected %s", glob, like, expected)
+		}
+	}
+}
+
+func TestLogQueriesReadFinal(t *testing.T) {
+	opt := QueryLogOption{Tag: "web", EndTime: 1}
+	queries := map[string]string{}
+	queries["log"], _ = buildLogQuery(opt)
+	queries["containers"], _ = buildContainerQuery(opt)
+	queries["histogram"], _ = buildHistogramQuery(HistogramOption{QueryLogOption: opt, Interval: 1000})
+	queries["count"], _ = buildCountQuery(StatsOption{QueryLogOption: opt})
+	queries["top"], _ = buildTopQuery(StatsOption{QueryLogOption: opt, Top: 10})
+	queries["context keys"], _ = buildContextKeyQuery(ContextOption{QueryLogOption: opt, Top: 10})
+	queries["context values"], _ = buildContextValueQuery(ContextOption{QueryLogOption: opt, Key: "k", Top: 10})
+	queries["lookup"], _ = buildLookupQuery(1, "web", false)
+	queries["surrounding"], _ = buildSurroundingQuery(OutputLogPayload{InputLogPayload: InputLogPayload{Tag: "web"}}, 10, true)
+	for name, query := range queries {
+		if !strings.Contains(query, "FROM "+DatabaseName+"."+LogTableName+" FINAL") {
+			t.Errorf("expected %s query to read the logs with FINAL, got %s", name, query)
+		}
+	}
+}
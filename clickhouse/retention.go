@@ -0,0 +1,147 @@
+package clickhouse
+
+import (
+	"database/sql"
+	"fmt"
+	. "hermes/core"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	RetentionTableName = "retention"
+
+	/** 2100-01-01, the TTL of logs that are kept forever */
+	keepForever = 4102444800
+)
+
+func quote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `'`, `\'`, -1)
+	return "'" + s + "'"
+}
+
+/**
+ttlExpression turns the retention rules into one TTL expression of the logs
+table. Rules are tried in order through multiIf, so the most specific rule
+that matches a row decides when it expires.
+*/
+func ttlExpression(rules []RetentionRule) string {
+	if len(rules) == 0 {
+		return ""
+	}
+	args := make([]string, 0)
+	keep := "0"
+	for _, r := range rules {
+		conditions := make([]string, 0, 2)
+		if r.Tag != "" {
+			conditions = append(conditions, fmt.Sprintf("tag = %s", quote(r.Tag)))
+		}
+		if r.HasLevel {
+			conditions = append(conditions, fmt.Sprintf("level = %d", r.Level))
+		}
+		seconds := fmt.Sprintf("%d", int64(r.Keep/time.Second))
+		if len(conditions) == 0 {
+			keep = seconds
+			break
+		}
+		args = append(args, strings.Join(conditions, " AND "), seconds)
+	}
+	if len(args) > 0 {
+		keep = fmt.Sprintf("multiIf(%s, %s)", strings.Join(args, ", "), keep)
+	}
+	return fmt.Sprintf("if(%[1]s = 0, toDateTime(%[2]d), addSeconds(toDateTime(intDiv(timestamp, 1000)), %[1]s))",
+		keep, keepForever)
+}
+
+/**
+catalogTtlExpression expires the days of the tag catalog once the longest
+retention has passed, a day holds logs until its end. Without a rule for every
+log some are kept forever, and so is the catalog.
+*/
+func catalogTtlExpression(rules []RetentionRule) string {
+	var longest time.Duration
+	bounded := false
+	for _, r := range rules {
+		if r.Keep > longest {
+			longest = r.Keep
+		}
+		if r.Tag == "" && !r.HasLevel {
+			bounded = true
+		}
+	}
+	if !bounded {
+		return ""
+	}
+	return fmt.Sprintf("addSeconds(toDateTime(day), %d)", int64((longest+24*time.Hour)/time.Second))
+}
+
+/**
+ApplyRetention sets the TTL of the logs table and of the tag catalog.
+Modifying the TTL rewrites a table so it is only done when its expression
+differs from the last applied one. Both are recorded in the retention table,
+the catalog expression first on its own line; a record without one predates
+the catalog TTL.
+*/
+func (c *Connection) ApplyRetention(rules []RetentionRule) error {
+	expression := ttlExpression(rules)
+	catalogExpression := catalogTtlExpression(rules)
+
+	var last string
+	row := c.conn.QueryRow(fmt.Sprintf(`SELECT expression FROM %s.%s ORDER BY applied_at DESC LIMIT 1`,
+		DatabaseName, RetentionTableName))
+	err := row.Scan(&last)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("read retention of click-house get error %v", err)
+	}
+	lastCatalog := ""
+	if i := strings.Index(last, "\n"); i >= 0 {
+		lastCatalog, last = last[:i], last[i+1:]
+	}
+	if last == expression && lastCatalog == catalogExpression {
+		return nil
+	}
+
+	if last != expression {
+		if err := c.alterTtl(LogTableName, expression); err != nil {
+			return err
+		}
+	}
+	if lastCatalog != catalogExpression {
+		if err := c.alterTtl(CatalogTableName, catalogExpression); err != nil {
+			return err
+		}
+	}
+
+	tx, err := c.conn.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(fmt.Sprintf(`INSERT INTO %s.%s (expression, applied_at) VALUES (?, ?)`,
+		DatabaseName, RetentionTableName))
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	defer func() {
+		_ = stmt.Close()
+	}()
+	if _, err := stmt.Exec(catalogExpression+"\n"+expression, time.Now()); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (c *Connection) alterTtl(table, expression string) error {
+	alterScript := fmt.Sprintf(`ALTER TABLE %s.%s REMOVE TTL`, DatabaseName, table)
+	if expression != "" {
+		alterScript = fmt.Sprintf(`ALTER TABLE %s.%s MODIFY TTL %s`, DatabaseName, table, expression)
+	}
+	log.Println(`query:`, alterScript)
+	if _, err := c.conn.Exec(alterScript); err != nil {
+		return fmt.Errorf("apply retention to click-house get error %v", err)
+	}
+	return nil
+}
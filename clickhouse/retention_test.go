@@ -0,0 +1,57 @@
+package clickhouse
+
+import (
+	. "hermes/core"
+	"testing"
+	"time"
+)
+
+func TestTtlExpression(t *testing.T) {
+	if e := ttlExpression(nil); e != "" {
+		t.Fatalf("expected no TTL without rules, got %s", e)
+	}
+
+	rules := []RetentionRule{
+		{Tag: "it's", Level: LevelDebugInt, HasLevel: true, Keep: time.Hour},
+		{Tag: "billing", Keep: 2 * time.Hour},
+		{Level: LevelInfoInt, HasLevel: true, Keep: 3 * time.Hour},
+		{Keep: 4 * time.Hour},
+		{Tag: "ignored", Keep: 5 * time.Hour},
+	}
+	expected := `if(multiIf(tag = 'it\'s' AND level = 100, 3600, tag = 'billing', 7200, level = 200, 10800, 14400) = 0, ` +
+		`toDateTime(4102444800), addSeconds(toDateTime(intDiv(timestamp, 1000)), ` +
+		`multiIf(tag = 'it\'s' AND level = 100, 3600, tag = 'billing', 7200, level = 200, 10800, 14400)))`
+	if e := ttlExpression(rules); e != expected {
+		t.Fatalf("unexpected TTL expression\n%s\nexpected\n%s", e, expected)
+	}
+}
+
+func TestTtlExpressionKeepsUnmatchedForever(t *testing.T) {
+	rules := []RetentionRule{{Tag: "web", Keep: time.Hour}}
+	expected := `if(multiIf(tag = 'web', 3600, 0) = 0, toDateTime(4102444800), ` +
+		`addSeconds(toDateTime(intDiv(timestamp, 1000)), multiIf(tag = 'web', 3600, 0)))`
+	if e := ttlExpression(rules); e != expected {
+		t.Fatalf("unexpected TTL expression\n%s\nexpected\n%s", e, expected)
+	}
+
+	expected = `if(60 = 0, toDateTime(4102444800), addSeconds(toDateTime(intDiv(timestamp, 1000)), 60))`
+	if e := ttlExpression([]RetentionRule{{Keep: time.Minute}}); e != expected {
+		t.Fatalf("unexpected TTL expression\n%s\nexpected\n%s", e, expected)
+	}
+}
+
+func TestCatalogTtlExpression(t *testing.T) {
+	rules := []RetentionRule{
+		{Tag: "billing", Keep: 48 * time.Hour},
+		{Level: LevelInfoInt, HasLevel: true, Keep: 3 * time.Hour},
+	}
+	if e := catalogTtlExpression(rules); e != "" {
+		t.Fatalf("expected no catalog TTL while logs are kept forever, got %s", e)
+	}
+
+	rules = append(rules, RetentionRule{Keep: 4 * time.Hour})
+	expected := `addSeconds(toDateTime(day), 259200)`
+	if e := catalogTtlExpression(rules); e != expected {
+		t.Fatalf("unexpected catalog TTL expression\n%s\nexpected\n%s", e, expected)
+	}
+}
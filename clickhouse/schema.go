@@ -0,0 +1,335 @@
+package clickhouse
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+const SchemaTableName = "schema_migrations"
+
+/**
+A migration is applied once and recorded in the schema_migrations table.
+Statements must be idempotent (IF NOT EXISTS, ...) since several hermes nodes
+may migrate the same database at the same time. A migration that needs more
+than statements applies itself, it must be safe to run again after a partial
+failure. Manual migrations are only applied by the migrate command.
+*/
+type migration struct {
+	version     uint32
+	description string
+	statements  []string
+	apply       func(db *sql.DB) error
+	manual      bool
+}
+
+/**
+┌─────id──────┬─tag─┬──timestamp──┬───date───┬─container name──┬──level─┬─message─────────────┬─context.key───┬─context.value────┐
+│ 1234567890  │ app │ 12345678901 │ 20200507 │    container    │  info  │ This is log message │ ['a','b','c'] │ ['v1','v2','v3'] │
+└─────────────┴─────┴─────────────┴──────────┴─────────────────┴────────┴─────────────────────┴───────────────┴──────────────────┘
+
+New migrations are appended with the next version, applied ones must never
+change.
+*/
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create logs table",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS %[1]s.%[2]s (
+  id             Int64,
+  tag            String,
+  timestamp      Int64,
+  date           String,
+  container_name String,
+  level          Int32,
+  message        String,
+  context        Nested(key String, value String)
+) ENGINE = MergeTree()
+PARTITION BY toYYYYMM(toDateTime(intDiv(timestamp, 1000)))
+ORDER BY (tag, timestamp, id)`,
+		},
+	},
+	{
+		version:     2,
+		description: "create retention table",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS %[1]s.retention (
+  expression String,
+  applied_at DateTime
+) ENGINE = TinyLog`,
+		},
+	},
+	{
+		version:     3,
+		description: "add skip indexes for searching message",
+		statements: []string{
+			`ALTER TABLE %[1]s.%[2]s ADD INDEX IF NOT EXISTS message_tokens message TYPE tokenbf_v1(32768, 3, 0) GRANULARITY 4`,
+			`ALTER TABLE %[1]s.%[2]s ADD INDEX IF NOT EXISTS message_ngrams message TYPE ngrambf_v1(3, 65536, 3, 0) GRANULARITY 4`,
+		},
+	},
+	{
+		version:     4,
+		description: "create tag catalog",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS %[1]s.` + CatalogTableName + ` (
+  tag          String,
+  day          Date,
+  first_seen   AggregateFunction(min, Int64),
+  last_seen    AggregateFunction(max, Int64),
+  total        AggregateFunction(count),
+  levels       AggregateFunction(sumMap, Array(Int32), Array(UInt64)),
+  context_keys AggregateFunction(groupUniqArrayArray, Array(String))
+) ENGINE = AggregatingMergeTree()
+PARTITION BY toYYYYMM(day)
+ORDER BY (tag, day)`,
+		},
+		apply: backfillCatalog,
+	},
+	{
+		version:     5,
+		description: "create id layout table",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS %[1]s.` + IdLayoutTableName + ` (
+  epoch      Int64,
+  node_bits  UInt8,
+  step_bits  UInt8,
+  applied_at DateTime
+) ENGINE = TinyLog`,
+		},
+	},
+	{
+		// The sorting key of a ReplacingMergeTree is its dedup key, so id gives
+		// way to event_id, the event id of the client or else the id. Logs
+		// collected meanwhile would be left in the old table, ingestion must be
+		// stopped while one node runs the migrate command.
+		version:     6,
+		description: "replace logs table to deduplicate client event ids",
+		apply:       replaceLogsTable,
+		manual:      true,
+	},
+}
+
+const catalogSelect = `SELECT
+  tag,
+  toDate(toDateTime(intDiv(timestamp, 1000))) AS day,
+  minState(timestamp) AS first_seen,
+  maxState(timestamp) AS last_seen,
+  countState() AS total,
+  sumMapState([level], [toUInt64(1)]) AS levels,
+  groupUniqArrayArrayState(context.key) AS context_keys
+FROM %[1]s.%[2]s
+GROUP BY tag, day`
+
+const replacingLogsTable = `CREATE TABLE IF NOT EXISTS %[1]s.%[2]s_replacing (
+  id             Int64,
+  tag            String,
+  timestamp      Int64,
+  date           String,
+  container_name String,
+  level          Int32,
+  message        String,
+  context        Nested(key String, value String),
+  event_id       String,
+  INDEX message_tokens message TYPE tokenbf_v1(32768, 3, 0) GRANULARITY 4,
+  INDEX message_ngrams message TYPE ngrambf_v1(3, 65536, 3, 0) GRANULARITY 4
+) ENGINE = ReplacingMergeTree()
+PARTITION BY toYYYYMM(toDateTime(intDiv(timestamp, 1000)))
+ORDER BY (tag, timestamp, event_id)`
+
+/**
+replaceLogsTable copies the logs to a ReplacingMergeTree and swaps the tables.
+Every step checks what the previous run left: the copy starts over until the
+old table is renamed to logs_merge_tree, the new table is then renamed to logs
+unless it already is.
+*/
+func replaceLogsTable(db *sql.DB) error {
+	steps := []string{`DROP TABLE IF EXISTS %[1]s.` + CatalogTableName + `_view`}
+	copied, err := tableExists(db, LogTableName+"_merge_tree")
+	if err != nil {
+		return err
+	}
+	if !copied {
+		steps = append(steps,
+			replacingLogsTable,
+			`TRUNCATE TABLE %[1]s.%[2]s_replacing`,
+			`INSERT INTO %[1]s.%[2]s_replacing
+  (id, tag, timestamp, date, container_name, level, message, context.key, context.value, event_id)
+SELECT id, tag, timestamp, date, container_name, level, message, context.key, context.value, toString(id)
+FROM %[1]s.%[2]s`,
+			`RENAME TABLE %[1]s.%[2]s TO %[1]s.%[2]s_merge_tree`)
+	}
+	if err := execSteps(db, steps); err != nil {
+		return err
+	}
+
+	steps = nil
+	replaced, err := tableExists(db, LogTableName)
+	if err != nil {
+		return err
+	}
+	if !replaced {
+		steps = append(steps, `RENAME TABLE %[1]s.%[2]s_replacing TO %[1]s.%[2]s`)
+	}
+	steps = append(steps,
+		`CREATE MATERIALIZED VIEW IF NOT EXISTS %[1]s.`+CatalogTableName+`_view TO %[1]s.`+CatalogTableName+` AS `+catalogSelect,
+		// the TTL of the old table is applied again to the new one
+		`TRUNCATE TABLE IF EXISTS %[1]s.`+RetentionTableName)
+	return execSteps(db, steps)
+}
+
+/**
+backfillCatalog creates the view of the tag catalog and copies the existing
+logs into it. The view is created before the copy so that no insert is missed,
+logs inserted meanwhile are counted twice. The copy only runs when the catalog
+was empty before the view, so a run after a partial failure does not count the
+logs again.
+*/
+func backfillCatalog(db *sql.DB) error {
+	var count uint64
+	row := db.QueryRow(fmt.Sprintf(`SELECT count() FROM %s.%s`, DatabaseName, CatalogTableName))
+	if err := row.Scan(&count); err != nil {
+		return fmt.Errorf("count tag catalog of click-house get error %v", err)
+	}
+	steps := []string{
+		`CREATE MATERIALIZED VIEW IF NOT EXISTS %[1]s.` + CatalogTableName + `_view TO %[1]s.` + CatalogTableName + ` AS ` + catalogSelect,
+	}
+	if count == 0 {
+		steps = append(steps, `INSERT INTO %[1]s.`+CatalogTableName+` `+catalogSelect)
+	}
+	return execSteps(db, steps)
+}
+
+/**
+logsStored tells whether the logs table holds rows, or whether a previous run
+of replaceLogsTable left the old one behind.
+*/
+func logsStored(db *sql.DB) (bool, error) {
+	left, err := tableExists(db, LogTableName+"_merge_tree")
+	if err != nil || left {
+		return left, err
+	}
+	exists, err := tableExists(db, LogTableName)
+	if err != nil || !exists {
+		return false, err
+	}
+	var count uint64
+	row := db.QueryRow(fmt.Sprintf(`SELECT count() FROM %s.%s`, DatabaseName, LogTableName))
+	if err := row.Scan(&count); err != nil {
+		return false, fmt.Errorf("count logs of click-house get error %v", err)
+	}
+	return count > 0, nil
+}
+
+func tableExists(db *sql.DB, table string) (bool, error) {
+	var exists uint8
+	row := db.QueryRow(fmt.Sprintf(`EXISTS TABLE %s.%s`, DatabaseName, table))
+	if err := row.Scan(&exists); err != nil {
+		return false, fmt.Errorf("check click-house table %s get error %v", table, err)
+	}
+	return exists == 1, nil
+}
+
+func execSteps(db *sql.DB, statements []string) error {
+	for _, statement := range statements {
+		script := fmt.Sprintf(statement, DatabaseName, LogTableName)
+		log.Println(`query:`, script)
+		if _, err := db.Exec(script); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+Migrate creates the database when it is missing and applies the migrations
+that are newer than the recorded schema version. Unless manual is set, it
+stops with an error at the first manual migration once logs are stored,
+whatever the recorded version: the logs table may predate the migrations.
+*/
+func Migrate(dsn string, manual bool) error {
+	db, err := sql.Open("clickhouse", dsn)
+	if err != nil {
+		return fmt.Errorf("can not connect to click-house db %v", err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	for _, script := range []string{
+		fmt.Sprintf(`CREATE DATABASE IF NOT EXISTS %s`, DatabaseName),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s.%s (
+  version     UInt32,
+  description String,
+  applied_at  DateTime
+) ENGINE = TinyLog`, DatabaseName, SchemaTableName),
+	} {
+		if _, err := db.Exec(script); err != nil {
+			return fmt.Errorf("bootstrap click-house schema get error %v", err)
+		}
+	}
+
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if m.manual && !manual {
+			stored, err := logsStored(db)
+			if err != nil {
+				return err
+			}
+			if stored {
+				return fmt.Errorf("click-house migration %d (%s) must be applied by the migrate command "+
+					"while ingestion is stopped", m.version, m.description)
+			}
+		}
+		log.Printf("apply click-house migration %d: %s\n", m.version, m.description)
+		err := execSteps(db, m.statements)
+		if err == nil && m.apply != nil {
+			err = m.apply(db)
+		}
+		if err != nil {
+			return fmt.Errorf("apply click-house migration %d get error %v", m.version, err)
+		}
+		if err := recordMigration(db, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func SchemaVersion(db *sql.DB) (uint32, error) {
+	var version uint32
+	row := db.QueryRow(fmt.Sprintf(`SELECT max(version) FROM %s.%s`, DatabaseName, SchemaTableName))
+	if err := row.Scan(&version); err != nil {
+		return 0, fmt.Errorf("read click-house schema version get error %v", err)
+	}
+	return version, nil
+}
+
+func recordMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(fmt.Sprintf(`INSERT INTO %s.%s (version, description, applied_at) VALUES (?, ?, ?)`,
+		DatabaseName, SchemaTableName))
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	defer func() {
+		_ = stmt.Close()
+	}()
+	if _, err := stmt.Exec(m.version, m.description, time.Now()); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,22 @@
+package clickhouse
+
+import (
+	"testing"
+)
+
+func TestMigrationsOrder(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != uint32(i+1) {
+			t.Fatalf("migration %d has version %d", i+1, m.version)
+		}
+		if len(m.statements) == 0 && m.apply == nil {
+			t.Fatalf("migration %d does nothing", m.version)
+		}
+	}
+	if migrations[3].apply == nil {
+		t.Fatal("expected the tag catalog to be backfilled by a func checking it is empty")
+	}
+	if m := migrations[5]; !m.manual || m.apply == nil {
+		t.Fatal("expected the replacement of the logs table to be a manual migration")
+	}
+}
@@ -5,17 +5,152 @@ import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"os"
+	"time"
+)
+
+const (
+	// AckNone answers the agent before the body is read (legacy behaviour)
+	AckNone = "none"
+	// AckMain answers once the main storage has accepted the batch
+	AckMain = "main"
+	// AckAll answers once every configured driver has accepted the batch
+	AckAll = "all"
+
+	// OverflowBlock waits for room in the queue. The main storage rejects the
+	// request instead so that agents back off
+	OverflowBlock = "block"
+	// OverflowDropOldest evicts the oldest queued batch
+	OverflowDropOldest = "drop_oldest"
+	// OverflowSpill writes the batch to disk and replays it later
+	OverflowSpill = "spill"
+
+	DefaultQueueSize         = 1024
+	DefaultQueueWorkers      = 1
+	DefaultQueueBlockTimeout = 5 * time.Second
+	// ClockWait sleeps until the clock catches up, up to MaxClockWait
+	ClockWait = "wait"
+	// ClockLogical keeps counting from the last id until the clock catches up
+	ClockLogical = "logical"
+	// ClockRefuse fails to generate ids until the clock catches up
+	ClockRefuse = "refuse"
+
+	DefaultMaxClockWait = 5 * time.Second
+
+	DefaultMaxBodySize = 64 << 20
+	DefaultMaxLineSize = 1 << 20
+	DefaultChunkSize   = 1000
 )
 
 type HermesConfig struct {
-	Port    int            `yaml:"port,omitempty"`
-	Drivers []DriverConfig `yaml:"drivers,omitempty"`
+	Port      int             `yaml:"port,omitempty"`
+	Id        IdConfig        `yaml:"id,omitempty"`
+	Ingest    IngestConfig    `yaml:"ingest,omitempty"`
+	Wal       WalConfig       `yaml:"wal,omitempty"`
+	Retention RetentionConfig `yaml:"retention,omitempty"`
+	Drivers   []DriverConfig  `yaml:"drivers,omitempty"`
+}
+
+/**
+IdConfig is the layout of the snowflake ids, Epoch is in milliseconds. It must
+not change once logs are stored: their ids would decode to another time and
+new ids could collide with them.
+*/
+type IdConfig struct {
+	Epoch    int64 `yaml:"epoch,omitempty"`
+	NodeBits uint8 `yaml:"node_bits,omitempty"`
+	StepBits uint8 `yaml:"step_bits,omitempty"`
+
+	// ClockRegression tells what to do when the clock is behind the last id.
+	// HighWaterFile keeps the last id time across restarts when it is set
+	ClockRegression string        `yaml:"clock_regression,omitempty"`
+	MaxClockWait    time.Duration `yaml:"max_clock_wait,omitempty"`
+	HighWaterFile   string        `yaml:"high_water_file,omitempty"`
+}
+
+/**
+MaxBodySize is the size in bytes a request body may have once decompressed,
+MaxLineSize the size of one of its lines. The logs of a body are delivered by
+chunks of ChunkSize logs while it is read.
+*/
+type IngestConfig struct {
+	Ack         string      `yaml:"ack,omitempty"`
+	Dedup       DedupConfig `yaml:"dedup,omitempty"`
+	MaxBodySize int64       `yaml:"max_body_size,omitempty"`
+	MaxLineSize int         `yaml:"max_line_size,omitempty"`
+	ChunkSize   int         `yaml:"chunk_size,omitempty"`
+}
+
+/**
+Event ids are deduplicated when Window is set, File keeps them across
+restarts.
+*/
+type DedupConfig struct {
+	Window time.Duration `yaml:"window,omitempty"`
+	File   string        `yaml:"file,omitempty"`
+}
+
+/**
+The write-ahead log is enabled when Dir is set. Sizes are in bytes.
+*/
+type WalConfig struct {
+	Dir              string        `yaml:"dir,omitempty"`
+	SegmentSize      int64         `yaml:"segment_size,omitempty"`
+	MaxSize          int64         `yaml:"max_size,omitempty"`
+	MaxAge           time.Duration `yaml:"max_age,omitempty"`
+	NoSync           bool          `yaml:"no_sync,omitempty"`
+	RetryInterval    time.Duration `yaml:"retry_interval,omitempty"`
+	MaxRetryInterval time.Duration `yaml:"max_retry_interval,omitempty"`
 }
 
 type DriverConfig struct {
-	Name          string   `yaml:"name,omitempty"`
-	IsMainStorage bool     `yaml:"main_storage,omitempty"`
-	Options       []string `yaml:"options,omitempty"`
+	Name          string      `yaml:"name,omitempty"`
+	IsMainStorage bool        `yaml:"main_storage,omitempty"`
+	Queue         QueueConfig `yaml:"queue,omitempty"`
+	Options       []string    `yaml:"options,omitempty"`
+}
+
+/**
+Size is the number of batches the queue of a driver holds. BlockTimeout bounds
+how long a request waits for room in the queue of a driver other than the main
+storage under the block policy. SpillMaxSize and SpillMaxAge limit the log of
+the spill policy like MaxSize and MaxAge of the write-ahead log, whose limits
+they default to.
+*/
+type QueueConfig struct {
+	Size         int           `yaml:"size,omitempty"`
+	Workers      int           `yaml:"workers,omitempty"`
+	Overflow     string        `yaml:"overflow,omitempty"`
+	SpillDir     string        `yaml:"spill_dir,omitempty"`
+	SpillMaxSize int64         `yaml:"spill_max_size,omitempty"`
+	SpillMaxAge  time.Duration `yaml:"spill_max_age,omitempty"`
+	BlockTimeout time.Duration `yaml:"block_timeout,omitempty"`
+}
+
+/** 41 bits of time and 22 bits shared by node and step */
+const idLayoutBits = 22
+
+func (c IdConfig) validate() error {
+	if int(c.NodeBits)+int(c.StepBits) > idLayoutBits {
+		return fmt.Errorf("node_bits and step_bits of id must not exceed %d bits together", idLayoutBits)
+	}
+	switch c.ClockRegression {
+	case ClockWait, ClockLogical, ClockRefuse:
+		break
+	default:
+		return fmt.Errorf("clock_regression %s of id is not supported", c.ClockRegression)
+	}
+	if c.Epoch < 0 || c.Epoch > time.Now().UnixNano()/int64(time.Millisecond) {
+		return fmt.Errorf("epoch %d of id must be in the past", c.Epoch)
+	}
+	return nil
+}
+
+func IsValidAckMode(mode string) bool {
+	switch mode {
+	case AckNone, AckMain, AckAll:
+		return true
+	}
+	return false
 }
 
 func ReadConfig(configFile string) (c HermesConfig, err error) {
@@ -35,5 +170,100 @@ func ReadConfig(configFile string) (c HermesConfig, err error) {
 		err = fmt.Errorf("unmarshal config file get error %v", err)
 		return
 	}
+
+	if c.Id.Epoch == 0 {
+		c.Id.Epoch = Epoch
+	}
+	/** zero is a valid number of bits, only missing ones get the default */
+	var bits struct {
+		Id struct {
+			NodeBits *uint8 `yaml:"node_bits"`
+			StepBits *uint8 `yaml:"step_bits"`
+		} `yaml:"id"`
+	}
+	_ = yaml.Unmarshal(yamlFile, &bits)
+	if bits.Id.NodeBits == nil {
+		c.Id.NodeBits = NodeBits
+	}
+	if bits.Id.StepBits == nil {
+		c.Id.StepBits = StepBits
+	}
+	if StrIsEmpty(c.Id.ClockRegression) {
+		c.Id.ClockRegression = ClockWait
+	}
+	if c.Id.MaxClockWait <= 0 {
+		c.Id.MaxClockWait = DefaultMaxClockWait
+	}
+	err = c.Id.validate()
+	if err != nil {
+		return
+	}
+
+	if StrIsEmpty(c.Ingest.Ack) {
+		c.Ingest.Ack = AckNone
+	}
+	if c.Ingest.MaxBodySize <= 0 {
+		c.Ingest.MaxBodySize = DefaultMaxBodySize
+	}
+	if c.Ingest.MaxLineSize <= 0 {
+		c.Ingest.MaxLineSize = DefaultMaxLineSize
+	}
+	if c.Ingest.ChunkSize <= 0 {
+		c.Ingest.ChunkSize = DefaultChunkSize
+	}
+	if !IsValidAckMode(c.Ingest.Ack) {
+		err = fmt.Errorf("ack mode %s is not supported", c.Ingest.Ack)
+		return
+	}
+
+	for i := range c.Drivers {
+		q := &c.Drivers[i].Queue
+		if q.Size <= 0 {
+			q.Size = DefaultQueueSize
+		}
+		if q.Workers <= 0 {
+			q.Workers = DefaultQueueWorkers
+		}
+		if StrIsEmpty(q.Overflow) {
+			q.Overflow = OverflowBlock
+		}
+		if q.BlockTimeout <= 0 {
+			q.BlockTimeout = DefaultQueueBlockTimeout
+		}
+		switch q.Overflow {
+		case OverflowBlock, OverflowDropOldest:
+			break
+		case OverflowSpill:
+			if StrIsEmpty(q.SpillDir) {
+				err = fmt.Errorf("missing spill_dir in queue of driver %s", c.Drivers[i].Name)
+				return
+			}
+			if q.SpillMaxSize <= 0 {
+				q.SpillMaxSize = c.Wal.MaxSize
+			}
+			if q.SpillMaxAge <= 0 {
+				q.SpillMaxAge = c.Wal.MaxAge
+			}
+			break
+		default:
+			err = fmt.Errorf("overflow policy %s of driver %s is not supported", q.Overflow, c.Drivers[i].Name)
+			return
+		}
+	}
+
+	err = c.Retention.validate()
+	if err != nil {
+		return
+	}
+
+	if c.Wal.RetryInterval <= 0 {
+		c.Wal.RetryInterval = time.Second
+	}
+	if c.Wal.MaxRetryInterval <= 0 {
+		c.Wal.MaxRetryInterval = time.Minute
+	}
+	if c.Wal.MaxRetryInterval < c.Wal.RetryInterval {
+		c.Wal.MaxRetryInterval = c.Wal.RetryInterval
+	}
 	return
 }
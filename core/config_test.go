@@ -0,0 +1,74 @@
+package core
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readTestConfig(t *testing.T, content string) (HermesConfig, error) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return ReadConfig(file)
+}
+
+func TestReadConfigIdBits(t *testing.T) {
+	c, err := readTestConfig(t, "port: 8080\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Id.NodeBits != NodeBits || c.Id.StepBits != StepBits || c.Id.Epoch != Epoch {
+		t.Fatalf("expected default id layout, got %+v", c.Id)
+	}
+
+	c, err = readTestConfig(t, "id:\n  node_bits: 0\n  step_bits: 22\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Id.NodeBits != 0 || c.Id.StepBits != 22 {
+		t.Fatalf("expected explicit zero node_bits to be kept, got %+v", c.Id)
+	}
+
+	c, err = readTestConfig(t, "id:\n  step_bits: 0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Id.NodeBits != NodeBits || c.Id.StepBits != 0 {
+		t.Fatalf("expected explicit zero step_bits to be kept, got %+v", c.Id)
+	}
+
+	if _, err = readTestConfig(t, "id:\n  node_bits: 12\n  step_bits: 12\n"); err == nil {
+		t.Fatal("expected more than 22 bits to be rejected")
+	}
+}
+
+func TestReadConfigSpillLimits(t *testing.T) {
+	c, err := readTestConfig(t, `wal:
+  max_size: 1024
+  max_age: 1h
+drivers:
+  - name: file
+    queue:
+      overflow: spill
+      spill_dir: /tmp/spill
+  - name: other
+    queue:
+      overflow: spill
+      spill_dir: /tmp/spill
+      spill_max_size: 2048
+      spill_max_age: 2h
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := c.Drivers[0].Queue; q.SpillMaxSize != 1024 || q.SpillMaxAge != time.Hour {
+		t.Fatalf("expected spill limits of the write-ahead log, got %+v", q)
+	}
+	if q := c.Drivers[1].Queue; q.SpillMaxSize != 2048 || q.SpillMaxAge != 2*time.Hour {
+		t.Fatalf("expected explicit spill limits to be kept, got %+v", q)
+	}
+}
@@ -1,6 +1,11 @@
 package core
 
-import "context"
+import (
+	"context"
+	"errors"
+)
+
+var ErrLogNotFound = errors.New("log not found")
 
 type LogDriver interface {
 	Open(config DriverConfig) error
@@ -10,14 +15,206 @@ type LogDriver interface {
 	Close() error
 }
 
+/**
+SchemaMigrator is implemented by drivers that manage the layout of their
+storage. Migrate is run by the `hermes migrate` command without opening the
+driver.
+*/
+type SchemaMigrator interface {
+	Migrate(config DriverConfig) error
+}
+
+/**
+RetentionEnforcer is implemented by drivers that expire logs by themselves.
+ApplyRetention is called once the driver is open.
+*/
+type RetentionEnforcer interface {
+	ApplyRetention(r RetentionConfig) error
+}
+
+/**
+IdLayoutChecker is implemented by drivers that store the ids of logs. The
+layout is recorded on first use and CheckIdLayout fails when it changes or
+when new ids would not sort after the stored ones.
+*/
+type IdLayoutChecker interface {
+	CheckIdLayout(layout IdConfig) error
+}
+
+/**
+ContainerFinder is implemented by drivers that can list the containers of a
+tag. Only the tag, level and time range of opt are used.
+*/
+type ContainerFinder interface {
+	FindContainers(ctx context.Context, opt QueryLogOption) ([]ContainerCount, error)
+}
+
+type ContainerCount struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+/**
+TagCataloger is implemented by drivers that keep a summary of every tag up to
+date while logs are collected. Volume holds the count of logs per day for the
+last days.
+*/
+type TagCataloger interface {
+	TagCatalog(ctx context.Context, days int) ([]TagInfo, error)
+}
+
+type TagInfo struct {
+	Tag         string            `json:"tag"`
+	FirstSeen   int64             `json:"first_seen"`
+	LastSeen    int64             `json:"last_seen"`
+	Count       uint64            `json:"count"`
+	Levels      map[string]uint64 `json:"levels,omitempty"`
+	ContextKeys []string          `json:"context_keys,omitempty"`
+	Volume      []DayVolume       `json:"volume,omitempty"`
+}
+
+type DayVolume struct {
+	Day   string `json:"day"`
+	Count uint64 `json:"count"`
+}
+
+/**
+ContextExplorer is implemented by drivers that can list the context keys of
+the logs matching the filters of ContextOption.QueryLogOption and the values
+of one key, the most frequent first.
+*/
+type ContextExplorer interface {
+	ContextKeys(ctx context.Context, opt ContextOption) ([]StatsGroup, error)
+	ContextValues(ctx context.Context, opt ContextOption) ([]StatsGroup, error)
+}
+
+/**
+Key is the key whose values are listed, it is ignored when listing keys.
+Only keys or values starting with Prefix are listed.
+*/
+type ContextOption struct {
+	QueryLogOption
+	Key    string
+	Prefix string
+	Top    int32
+}
+
+/**
+LogFinder is implemented by drivers that can find a log by its id, it returns
+ErrLogNotFound when the log does not exist.
+*/
+type LogFinder interface {
+	FindLog(ctx context.Context, id int64) (OutputLogPayload, error)
+}
+
+/**
+SurroundingFinder is implemented by drivers that can list the logs written
+right before and after a log, from its tag and container whatever the filters
+that found it. The log itself is part of the list, ErrLogNotFound is returned
+when it does not exist.
+*/
+type SurroundingFinder interface {
+	FindSurrounding(ctx context.Context, opt SurroundingOption) ([]OutputLogPayload, error)
+}
+
+/**
+Tag is optional, it only makes the log cheaper to find.
+*/
+type SurroundingOption struct {
+	Id     int64
+	Tag    string
+	Before int32
+	After  int32
+}
+
+/**
+LogAggregator is implemented by drivers that can aggregate logs by
+themselves, instead of having the rows pulled out of them.
+*/
+type LogAggregator interface {
+	Histogram(ctx context.Context, opt HistogramOption) ([]HistogramBucket, error)
+	Stats(ctx context.Context, opt StatsOption) (LogStats, error)
+}
+
+const (
+	GroupByContainer = "container"
+	GroupByContext   = "context"
+
+	FieldTag       = "tag"
+	FieldContainer = "container"
+	FieldLevel     = "level"
+	FieldMessage   = "message"
+	FieldContext   = "context"
+)
+
+/**
+StatsOption counts the logs matching the filters of QueryLogOption, the
+distinct values of Field and its Top most frequent values. An empty Tag
+matches every tag. Logs without ContextKey are left out when Field is context.
+*/
+type StatsOption struct {
+	QueryLogOption
+	Field      string
+	ContextKey string
+	Top        int32
+}
+
+/**
+Distinct is an approximation on large sets.
+*/
+type LogStats struct {
+	Count    uint64       `json:"count"`
+	Distinct uint64       `json:"distinct"`
+	Top      []StatsGroup `json:"top,omitempty"`
+}
+
+type StatsGroup struct {
+	Value string `json:"value"`
+	Count uint64 `json:"count"`
+}
+
+/**
+HistogramOption counts the logs matching the filters of QueryLogOption per
+Interval milliseconds and level, split by container or by the value of
+ContextKey according to GroupBy.
+*/
+type HistogramOption struct {
+	QueryLogOption
+	Interval   int64
+	GroupBy    string
+	ContextKey string
+}
+
+type HistogramBucket struct {
+	Timestamp int64  `json:"timestamp"`
+	Level     string `json:"level"`
+	Group     string `json:"group,omitempty"`
+	Count     uint64 `json:"count"`
+}
+
+/**
+LastId and LastTimestamp are the keyset of the row a page continues from, rows
+are ordered on (timestamp, id). LastTimestamp is looked up by the driver when
+only LastId is known. Backward returns the page before the keyset instead of
+after it and needs a Limit.
+*/
 type QueryLogOption struct {
-	Tag       string
-	LogLevel  int32
-	StartTime int64
-	EndTime   int64
-	LastId    int64
-	BatchSize int32
-	Response  chan OutputLogMessage
+	Tag           string
+	LogLevel      int32
+	StartTime     int64
+	EndTime       int64
+	LastId        int64
+	LastTimestamp int64
+	Limit         int32
+	Descending    bool
+	Backward      bool
+	Message       []MessageFilter
+	Context       []ContextFilter
+	// Containers and ExcludeContainers are glob patterns (* and ?) of container names
+	Containers        []string
+	ExcludeContainers []string
+	BatchSize         int32
+	Response          chan OutputLogMessage
 }
 
 type LogEntry struct {
@@ -30,4 +227,5 @@ type LogEntry struct {
 	Message       string
 	ContextKeys   []string
 	ContextValues []string
+	EventId       string
 }
@@ -0,0 +1,98 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"unicode/utf8"
+)
+
+const (
+	// MatchSubstring finds the pattern anywhere in the message
+	MatchSubstring = "substring"
+	// MatchToken finds the pattern as a whole word of the message
+	MatchToken = "token"
+	// MatchRegex matches the message against a RE2 regular expression
+	MatchRegex = "regex"
+
+	ContextEquals    = "eq"
+	ContextNotEquals = "ne"
+	ContextExists    = "exists"
+	ContextIn        = "in"
+	ContextPrefix    = "prefix"
+)
+
+/**
+MessageFilter matches the message of logs. Filters of a query are combined
+with AND.
+*/
+type MessageFilter struct {
+	Mode            string `json:"mode,omitempty"`
+	Pattern         string `json:"pattern"`
+	CaseInsensitive bool   `json:"case_insensitive,omitempty"`
+	Negate          bool   `json:"negate,omitempty"`
+}
+
+func (f *MessageFilter) Validate() error {
+	if f.Mode == "" {
+		f.Mode = MatchSubstring
+	}
+	if f.Pattern == "" {
+		return fmt.Errorf("missing pattern of message filter")
+	}
+	switch f.Mode {
+	case MatchSubstring:
+		return nil
+	case MatchToken:
+		for i := 0; i < len(f.Pattern); i++ {
+			if IsTokenSeparator(f.Pattern[i]) {
+				return fmt.Errorf("token %s must not contain separators", f.Pattern)
+			}
+		}
+		return nil
+	case MatchRegex:
+		if _, err := regexp.Compile(f.Pattern); err != nil {
+			return fmt.Errorf("regex %s is not valid: %v", f.Pattern, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("message filter mode %s is not supported", f.Mode)
+}
+
+/**
+IsTokenSeparator tells whether b splits the tokens of a message the way
+hasToken of ClickHouse does: every ASCII byte but letters and digits, the
+underscore included. Bytes of non-ASCII characters belong to tokens.
+*/
+func IsTokenSeparator(b byte) bool {
+	return b < utf8.RuneSelf && !('a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9')
+}
+
+/**
+ContextFilter matches a key of the log context. Value is compared by eq, ne
+and prefix, Values by in. A log without the key only passes ne.
+*/
+type ContextFilter struct {
+	Key    string   `json:"key"`
+	Op     string   `json:"op,omitempty"`
+	Value  string   `json:"value,omitempty"`
+	Values []string `json:"values,omitempty"`
+}
+
+func (f *ContextFilter) Validate() error {
+	if f.Op == "" {
+		f.Op = ContextEquals
+	}
+	if f.Key == "" {
+		return fmt.Errorf("missing key of context filter")
+	}
+	switch f.Op {
+	case ContextEquals, ContextNotEquals, ContextExists, ContextPrefix:
+		return nil
+	case ContextIn:
+		if len(f.Values) == 0 {
+			return fmt.Errorf("missing values of context filter on %s", f.Key)
+		}
+		return nil
+	}
+	return fmt.Errorf("context filter op %s is not supported", f.Op)
+}
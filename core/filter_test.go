@@ -0,0 +1,20 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestMessageFilterTokenSeparators(t *testing.T) {
+	for _, pattern := range []string{"timeout", "Error42", "café"} {
+		f := MessageFilter{Mode: MatchToken, Pattern: pattern}
+		if err := f.Validate(); err != nil {
+			t.Errorf("expected token %s to be valid, got %v", pattern, err)
+		}
+	}
+	for _, pattern := range []string{"user_id", "a b", "a-b", "a.b", "a\x7f"} {
+		f := MessageFilter{Mode: MatchToken, Pattern: pattern}
+		if err := f.Validate(); err == nil {
+			t.Errorf("expected token %q to be rejected", pattern)
+		}
+	}
+}
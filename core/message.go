@@ -1,6 +1,9 @@
 package core
 
-import "strings"
+import (
+	"sort"
+	"strings"
+)
 
 /** Input */
 type InputLogPayload struct {
@@ -10,6 +13,9 @@ type InputLogPayload struct {
 	Level         string          `json:"level,omitempty"`
 	Message       string          `json:"message,omitempty"`
 	Context       InputLogContext `json:"context,omitempty"`
+	// EventId is set by the client so that a log sent again within the dedup
+	// window is stored once
+	EventId string `json:"event_id,omitempty"`
 }
 
 const (
@@ -88,6 +94,9 @@ func LogLevelInt(level string) int32 {
 
 type InputLogContext map[string]string
 
+/**
+Keys are sorted so that they line up with Values.
+*/
 func (m InputLogContext) Keys() []string {
 	if m == nil {
 		return []string{}
@@ -96,16 +105,15 @@ func (m InputLogContext) Keys() []string {
 	for k := range m {
 		rs = append(rs, k)
 	}
+	sort.Strings(rs)
 	return rs
 }
 
 func (m InputLogContext) Values() []string {
-	if m == nil {
-		return []string{}
-	}
-	rs := make([]string, 0, len(m))
-	for _, v := range m {
-		rs = append(rs, v)
+	keys := m.Keys()
+	rs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		rs = append(rs, m[k])
 	}
 	return rs
 }
@@ -121,9 +129,108 @@ type OutputTagMessage struct {
 	Data []string `json:"data,omitempty"`
 }
 
+type OutputCatalogMessage struct {
+	OutputMessage
+	Data []TagInfo `json:"data,omitempty"`
+}
+
+type OutputHistogramMessage struct {
+	OutputMessage
+	Interval int64             `json:"interval,omitempty"`
+	Data     []HistogramBucket `json:"data,omitempty"`
+}
+
+type OutputStatsMessage struct {
+	OutputMessage
+	Data *LogStats `json:"data,omitempty"`
+}
+
+type OutputContextMessage struct {
+	OutputMessage
+	Data []StatsGroup `json:"data,omitempty"`
+}
+
+type OutputContainerMessage struct {
+	OutputMessage
+	Data []ContainerCount `json:"data,omitempty"`
+}
+
+type OutputIdMessage struct {
+	OutputMessage
+	Data *IdInfo `json:"data,omitempty"`
+}
+
+/**
+IdInfo is a snowflake id in every encoding accepted by the API, with the
+parts it is made of. Time is in milliseconds.
+*/
+type IdInfo struct {
+	Id     int64  `json:"id"`
+	IdStr  string `json:"id_str"`
+	Base58 string `json:"base58"`
+	Base32 string `json:"base32"`
+	Time   int64  `json:"time"`
+	Date   string `json:"date"`
+	Node   int64  `json:"node"`
+	Step   int64  `json:"step"`
+}
+
+type OutputRetentionMessage struct {
+	OutputMessage
+	Data []RetentionPolicy `json:"data,omitempty"`
+}
+
+type OutputIngestMessage struct {
+	OutputMessage
+	Accepted   int `json:"accepted"`
+	Rejected   int `json:"rejected"`
+	Duplicates int `json:"duplicates,omitempty"`
+	// NotAttempted is the number of lines after a chunk refused by storage,
+	// they are neither accepted nor rejected
+	NotAttempted int           `json:"not_attempted,omitempty"`
+	Errors       []IngestError `json:"errors,omitempty"`
+}
+
+/**
+Line is the 1-based line number in the request body. It is zero when the
+error concerns the whole batch, e.g. a driver refused it.
+*/
+type IngestError struct {
+	Line   int    `json:"line,omitempty"`
+	Driver string `json:"driver,omitempty"`
+	Error  string `json:"error"`
+}
+
 type OutputLogMessage struct {
 	OutputMessage
-	Data []OutputLogPayload `json:"data,omitempty"`
+	Data   []OutputLogPayload `json:"data,omitempty"`
+	Cursor *PageCursor        `json:"cursor,omitempty"`
+}
+
+type OutputEntryMessage struct {
+	OutputMessage
+	Data *OutputLogPayload `json:"data,omitempty"`
+}
+
+/**
+Dropped is the number of logs a live tail has lost since its last message.
+*/
+type OutputTailMessage struct {
+	OutputMessage
+	Data    []OutputLogPayload `json:"data,omitempty"`
+	Dropped uint64             `json:"dropped,omitempty"`
+}
+
+/**
+PageCursor is sent with the last message of a query. The keyset of Last asks
+for the next page, the keyset of First with backward set for the previous one.
+*/
+type PageCursor struct {
+	FirstId        string `json:"first_id,omitempty"`
+	FirstTimestamp int64  `json:"first_timestamp,omitempty"`
+	LastId         string `json:"last_id,omitempty"`
+	LastTimestamp  int64  `json:"last_timestamp,omitempty"`
+	HasMore        bool   `json:"has_more"`
 }
 
 type OutputLogPayload struct {
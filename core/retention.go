@@ -0,0 +1,158 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+/**
+Retention of logs. Durations left out (or zero) fall back to the next rule:
+level of the tag, default of the tag, level, default. Logs matched by no rule
+are kept forever.
+*/
+type RetentionConfig struct {
+	Default time.Duration            `yaml:"default,omitempty"`
+	Levels  map[string]time.Duration `yaml:"levels,omitempty"`
+	Tags    map[string]TagRetention  `yaml:"tags,omitempty"`
+}
+
+type TagRetention struct {
+	Default time.Duration            `yaml:"default,omitempty"`
+	Levels  map[string]time.Duration `yaml:"levels,omitempty"`
+}
+
+/**
+A RetentionRule matches logs by tag and level. An empty Tag matches every tag
+and Level is only compared when HasLevel is set.
+*/
+type RetentionRule struct {
+	Tag      string
+	Level    int32
+	HasLevel bool
+	Keep     time.Duration
+}
+
+/**
+RetentionPolicy is the effective retention of a tag in seconds per level name,
+zero means forever.
+*/
+type RetentionPolicy struct {
+	Tag    string           `json:"tag"`
+	Levels map[string]int64 `json:"levels"`
+}
+
+var retentionLevels = []string{
+	LevelAll, LevelDebug, LevelInfo, LevelNotice, LevelWarning,
+	LevelError, LevelCritical, LevelAlert, LevelEmergency,
+}
+
+func (r RetentionConfig) validate() error {
+	check := func(levels map[string]time.Duration) error {
+		for name, d := range levels {
+			if name == LevelDefault {
+				/** logs of the default level are stored as ALL */
+				return fmt.Errorf("level %s in retention is not supported, use %s", name, LevelAll)
+			}
+			if !isLevelName(name) {
+				return fmt.Errorf("unknown level %s in retention", name)
+			}
+			if d < 0 {
+				return fmt.Errorf("retention of level %s must not be negative", name)
+			}
+		}
+		return nil
+	}
+	if r.Default < 0 {
+		return fmt.Errorf("default retention must not be negative")
+	}
+	if err := check(r.Levels); err != nil {
+		return err
+	}
+	for tag, t := range r.Tags {
+		if t.Default < 0 {
+			return fmt.Errorf("default retention of tag %s must not be negative", tag)
+		}
+		if err := check(t.Levels); err != nil {
+			return fmt.Errorf("%v of tag %s", err, tag)
+		}
+	}
+	return nil
+}
+
+func isLevelName(name string) bool {
+	for _, v := range retentionLevels {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+Keep returns how long logs of tag and level are kept, zero means forever.
+*/
+func (r RetentionConfig) Keep(tag string, level int32) time.Duration {
+	name := LogLevelStr(level)
+	if t, ok := r.Tags[tag]; ok {
+		if d := t.Levels[name]; d > 0 {
+			return d
+		}
+		if t.Default > 0 {
+			return t.Default
+		}
+	}
+	if d := r.Levels[name]; d > 0 {
+		return d
+	}
+	return r.Default
+}
+
+func (r RetentionConfig) Policy(tag string) RetentionPolicy {
+	p := RetentionPolicy{
+		Tag:    tag,
+		Levels: make(map[string]int64),
+	}
+	for _, name := range retentionLevels {
+		p.Levels[name] = int64(r.Keep(tag, LogLevelInt(name)) / time.Second)
+	}
+	return p
+}
+
+/**
+Rules flattens the configuration from the most to the least specific rule, so
+the first rule that matches a log decides its retention.
+*/
+func (r RetentionConfig) Rules() []RetentionRule {
+	rules := make([]RetentionRule, 0)
+	levelRules := func(tag string, levels map[string]time.Duration) {
+		names := make([]string, 0, len(levels))
+		for name := range levels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if levels[name] > 0 {
+				rules = append(rules, RetentionRule{Tag: tag, Level: LogLevelInt(name), HasLevel: true, Keep: levels[name]})
+			}
+		}
+	}
+
+	tags := make([]string, 0, len(r.Tags))
+	for tag := range r.Tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		t := r.Tags[tag]
+		levelRules(tag, t.Levels)
+		if t.Default > 0 {
+			rules = append(rules, RetentionRule{Tag: tag, Keep: t.Default})
+		}
+	}
+	levelRules("", r.Levels)
+	if r.Default > 0 {
+		rules = append(rules, RetentionRule{Keep: r.Default})
+	}
+	return rules
+}
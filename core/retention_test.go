@@ -0,0 +1,92 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func testRetention() RetentionConfig {
+	return RetentionConfig{
+		Default: 30 * 24 * time.Hour,
+		Levels: map[string]time.Duration{
+			LevelDebug: 24 * time.Hour,
+		},
+		Tags: map[string]TagRetention{
+			"billing": {
+				Default: 365 * 24 * time.Hour,
+				Levels: map[string]time.Duration{
+					LevelDebug: 72 * time.Hour,
+				},
+			},
+			"audit": {
+				Levels: map[string]time.Duration{
+					LevelError: 90 * 24 * time.Hour,
+				},
+			},
+		},
+	}
+}
+
+func TestRetentionKeep(t *testing.T) {
+	r := testRetention()
+	cases := []struct {
+		tag   string
+		level int32
+		keep  time.Duration
+	}{
+		{"billing", LevelDebugInt, 72 * time.Hour},
+		{"billing", LevelInfoInt, 365 * 24 * time.Hour},
+		{"audit", LevelErrorInt, 90 * 24 * time.Hour},
+		{"audit", LevelDebugInt, 24 * time.Hour},
+		{"audit", LevelInfoInt, 30 * 24 * time.Hour},
+		{"web", LevelDebugInt, 24 * time.Hour},
+		{"web", LevelAllInt, 30 * 24 * time.Hour},
+	}
+	for _, c := range cases {
+		if keep := r.Keep(c.tag, c.level); keep != c.keep {
+			t.Errorf("keep of %s/%s is %v, expected %v", c.tag, LogLevelStr(c.level), keep, c.keep)
+		}
+	}
+
+	if keep := (RetentionConfig{}).Keep("web", LevelInfoInt); keep != 0 {
+		t.Errorf("expected logs to be kept forever without rules, got %v", keep)
+	}
+}
+
+func TestRetentionRulesOrder(t *testing.T) {
+	rules := testRetention().Rules()
+	expected := []RetentionRule{
+		{Tag: "audit", Level: LevelErrorInt, HasLevel: true, Keep: 90 * 24 * time.Hour},
+		{Tag: "billing", Level: LevelDebugInt, HasLevel: true, Keep: 72 * time.Hour},
+		{Tag: "billing", Keep: 365 * 24 * time.Hour},
+		{Level: LevelDebugInt, HasLevel: true, Keep: 24 * time.Hour},
+		{Keep: 30 * 24 * time.Hour},
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("expected %d rules, got %+v", len(expected), rules)
+	}
+	for i := range expected {
+		if rules[i] != expected[i] {
+			t.Errorf("rule %d is %+v, expected %+v", i, rules[i], expected[i])
+		}
+	}
+}
+
+func TestRetentionValidate(t *testing.T) {
+	if err := testRetention().validate(); err != nil {
+		t.Fatal(err)
+	}
+	invalid := []RetentionConfig{
+		{Default: -time.Hour},
+		{Levels: map[string]time.Duration{"VERBOSE": time.Hour}},
+		{Levels: map[string]time.Duration{LevelDefault: time.Hour}},
+		{Levels: map[string]time.Duration{LevelInfo: -time.Hour}},
+		{Tags: map[string]TagRetention{"web": {Default: -time.Hour}}},
+		{Tags: map[string]TagRetention{"web": {Levels: map[string]time.Duration{LevelDefault: time.Hour}}}},
+	}
+	for _, r := range invalid {
+		if err := r.validate(); err == nil {
+			t.Errorf("expected %+v to be rejected", r)
+		}
+	}
+}
@@ -4,7 +4,11 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
+	"expvar"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
 	"strconv"
 	"sync"
 	"time"
@@ -12,18 +16,34 @@ import (
 
 var SnowFlake *Node
 
-func InitIdGenerator(nodeId int64) (err error) {
+/**
+InitIdGenerator sets the layout of the ids before creating the generator of
+this node, then resumes from the high-water mark of the previous run if any.
+*/
+func InitIdGenerator(nodeId int64, layout IdConfig) (err error) {
+	Epoch = layout.Epoch
+	NodeBits = layout.NodeBits
+	StepBits = layout.StepBits
 	SnowFlake, err = NewNode(nodeId)
+	if err != nil {
+		return
+	}
+	SnowFlake.regression = layout.ClockRegression
+	SnowFlake.maxWait = layout.MaxClockWait
+	if !StrIsEmpty(layout.HighWaterFile) {
+		err = SnowFlake.loadHighWater(layout.HighWaterFile)
+	}
 	return
 }
 
-func NextId() int64 {
-	return int64(SnowFlake.Generate())
+func NextId() (int64, error) {
+	id, err := SnowFlake.Generate()
+	return int64(id), err
 }
 
 var (
-	// Epoch is set to the twitter snowflake epoch of Nov 04 2010 01:42:54 UTC in milliseconds
-	// You may customize this to set a different epoch for your application.
+	// Epoch is set to May 08 2020 08:50:29 UTC in milliseconds
+	// It is customized by the id section of the configuration.
 	Epoch int64 = 1588927829000
 
 	// NodeBits holds the number of bits to use for Node
@@ -56,11 +76,23 @@ var ErrInvalidBase58 = errors.New("invalid base58")
 // ErrInvalidBase32 is returned by ParseBase32 when given an invalid []byte
 var ErrInvalidBase32 = errors.New("invalid base32")
 
+// ErrClockRegression is returned by Generate when the clock is behind the last
+// generated ID and the node is configured not to wait or not that long
+var ErrClockRegression = errors.New("clock moved backwards")
+
+// ClockRegressions counts the times a node found its clock behind the last
+// generated ID, it is published with the other expvar variables
+var ClockRegressions = expvar.NewInt("snowflake_clock_regressions")
+
+// highWaterLease is how far ahead of the last generated ID the high-water
+// mark is written, so that the file is not written for every ID
+const highWaterLease = int64(1000)
+
 // Create maps for decoding Base58/Base32.
 // This speeds up the process tremendously.
 func init() {
 
-	for i := 0; i < len(encodeBase58Map); i++ {
+	for i := 0; i < len(decodeBase58Map); i++ {
 		decodeBase58Map[i] = 0xFF
 	}
 
@@ -68,7 +100,7 @@ func init() {
 		decodeBase58Map[encodeBase58Map[i]] = byte(i)
 	}
 
-	for i := 0; i < len(encodeBase32Map); i++ {
+	for i := 0; i < len(decodeBase32Map); i++ {
 		decodeBase32Map[i] = 0xFF
 	}
 
@@ -91,6 +123,13 @@ type Node struct {
 	stepMask  int64
 	timeShift uint8
 	nodeShift uint8
+
+	regression string
+	maxWait    time.Duration
+	markFile   string
+	mark       int64
+	resumed    int64
+	lagging    bool
 }
 
 // An ID is a custom type used for a snowflake ID.  This is used so we can
@@ -124,18 +163,55 @@ func NewNode(node int64) (*Node, error) {
 // To help guarantee uniqueness
 // - Make sure your system is keeping accurate system time
 // - Make sure you never have multiple nodes running with the same node ID
-func (n *Node) Generate() ID {
+// The clock of a running node is monotonic, it can only be found behind the
+// last ID when it lags the high-water mark of the previous run. Within the
+// lease of the mark the node just waits, beyond it the node waits, keeps
+// counting from the last ID or refuses according to its ClockRegression policy.
+func (n *Node) Generate() (ID, error) {
 
 	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := n.now()
 
-	now := time.Since(n.epoch).Nanoseconds() / 1000000
+	for now < n.time {
+		/** a node resumed from its mark lags it by the lease at most, that is no regression */
+		leased := n.time == n.resumed && n.time-now <= highWaterLease
+		if !n.lagging && !leased {
+			/** count the regressions, not the ids generated while lagging */
+			n.lagging = true
+			ClockRegressions.Add(1)
+		}
+		if n.regression == ClockLogical {
+			now = n.time
+			break
+		}
+		lag := time.Duration(n.time-now) * time.Millisecond
+		if !leased && n.regression == ClockRefuse {
+			return 0, ErrClockRegression
+		}
+		if !leased && lag > n.maxWait {
+			return 0, fmt.Errorf("%w by %v", ErrClockRegression, lag)
+		}
+		/** other callers may return errors meanwhile, n.time is checked again */
+		n.mu.Unlock()
+		time.Sleep(lag)
+		n.mu.Lock()
+		now = n.now()
+	}
+	if now > n.time {
+		n.lagging = false
+	}
 
 	if now == n.time {
 		n.step = (n.step + 1) & n.stepMask
 
 		if n.step == 0 {
+			if n.regression == ClockLogical {
+				now++
+			}
 			for now <= n.time {
-				now = time.Since(n.epoch).Nanoseconds() / 1000000
+				now = n.now()
 			}
 		}
 	} else {
@@ -143,14 +219,87 @@ func (n *Node) Generate() ID {
 	}
 
 	n.time = now
+	if n.markFile != "" && n.time >= n.mark {
+		n.saveHighWater(n.time + highWaterLease)
+	}
 
 	r := ID((now)<<n.timeShift |
 		(n.node << n.nodeShift) |
 		(n.step),
 	)
 
-	n.mu.Unlock()
-	return r
+	return r, nil
+}
+
+func (n *Node) now() int64 {
+	return time.Since(n.epoch).Nanoseconds() / 1000000
+}
+
+// loadHighWater makes the node generate IDs after the mark saved by the
+// previous run, whatever its clock says
+func (n *Node) loadHighWater(file string) error {
+	n.markFile = file
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read high-water mark of ids get error %v", err)
+	}
+	mark, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return fmt.Errorf("high-water mark of ids in %s is not valid", file)
+	}
+	if lag := mark - n.now(); lag > highWaterLease {
+		log.Printf("clock is %dms behind the high-water mark of ids\n", lag)
+	}
+	n.time = mark
+	n.mark = mark
+	n.resumed = mark
+	return nil
+}
+
+// saveHighWater replaces the mark through a temporary file so that a crash
+// never leaves a truncated one
+func (n *Node) saveHighWater(mark int64) {
+	tmp := n.markFile + ".tmp"
+	err := writeSynced(tmp, []byte(strconv.FormatInt(mark, 10)))
+	if err == nil {
+		err = os.Rename(tmp, n.markFile)
+	}
+	if err != nil {
+		log.Printf("save high-water mark of ids get error %v\n", err)
+		return
+	}
+	n.mark = mark
+}
+
+// writeSynced writes the file down to the disk, otherwise the rename could be
+// persisted before the content
+func writeSynced(file string, data []byte) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Close saves the time of the last ID as the high-water mark. A node stopped
+// without it resumes at the end of the lease, which Generate waits for
+// without counting a regression
+func (n *Node) Close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.markFile != "" {
+		n.saveHighWater(n.time + 1)
+	}
 }
 
 // Int64 returns an int64 of the snowflake ID
@@ -158,6 +307,21 @@ func (f ID) Int64() int64 {
 	return int64(f)
 }
 
+// Time returns an int64 unix timestamp in milliseconds of the snowflake ID time
+func (f ID) Time() int64 {
+	return (int64(f) >> (NodeBits + StepBits)) + Epoch
+}
+
+// Node returns an int64 of the snowflake ID node number
+func (f ID) Node() int64 {
+	return (int64(f) >> StepBits) & (-1 ^ (-1 << NodeBits))
+}
+
+// Step returns an int64 of the snowflake step (or sequence) number
+func (f ID) Step() int64 {
+	return int64(f) & (-1 ^ (-1 << StepBits))
+}
+
 // ParseInt64 converts an int64 into a snowflake ID
 func ParseInt64(id int64) ID {
 	return ID(id)
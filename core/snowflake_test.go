@@ -0,0 +1,219 @@
+package core
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func withLayout(t *testing.T, epoch int64, nodeBits uint8, stepBits uint8) {
+	t.Helper()
+	savedEpoch, savedNodeBits, savedStepBits := Epoch, NodeBits, StepBits
+	Epoch, NodeBits, StepBits = epoch, nodeBits, stepBits
+	t.Cleanup(func() {
+		Epoch, NodeBits, StepBits = savedEpoch, savedNodeBits, savedStepBits
+	})
+}
+
+func TestIdDecoding(t *testing.T) {
+	withLayout(t, 1600000000000, 4, 8)
+	id := ID(123456<<12 | 5<<8 | 42)
+	if id.Time() != 1600000000000+123456 || id.Node() != 5 || id.Step() != 42 {
+		t.Fatalf("id decodes to time %d, node %d, step %d", id.Time(), id.Node(), id.Step())
+	}
+
+	n, err := NewNode(15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := n.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if generated.Node() != 15 || generated.Step() != 0 {
+		t.Fatalf("generated id decodes to node %d, step %d", generated.Node(), generated.Step())
+	}
+	if _, err := NewNode(16); err == nil {
+		t.Fatal("expected node 16 to be rejected with 4 node bits")
+	}
+}
+
+func TestIdDecodingWithoutNodeBits(t *testing.T) {
+	withLayout(t, Epoch, 0, 22)
+	n, err := NewNode(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := n.Generate()
+	second, _ := n.Generate()
+	if first.Node() != 0 || second <= first {
+		t.Fatalf("unexpected ids %d and %d", first, second)
+	}
+	if _, err := NewNode(1); err == nil {
+		t.Fatal("expected node 1 to be rejected without node bits")
+	}
+}
+
+func TestIdEncodings(t *testing.T) {
+	id := ID(1234567890123456789)
+	if v, err := ParseString(id.String()); err != nil || v != id {
+		t.Fatalf("decimal %s decodes to %d, %v", id.String(), v, err)
+	}
+	if v, err := ParseBase58([]byte(id.Base58())); err != nil || v != id {
+		t.Fatalf("base58 %s decodes to %d, %v", id.Base58(), v, err)
+	}
+	if v, err := ParseBase32([]byte(id.Base32())); err != nil || v != id {
+		t.Fatalf("base32 %s decodes to %d, %v", id.Base32(), v, err)
+	}
+	if _, err := ParseBase58([]byte("abc-0")); err != ErrInvalidBase58 {
+		t.Fatalf("expected invalid base58, got %v", err)
+	}
+	if _, err := ParseBase32([]byte("ybn-d")); err != ErrInvalidBase32 {
+		t.Fatalf("expected invalid base32, got %v", err)
+	}
+}
+
+func laggingNode(t *testing.T, regression string, lag int64) *Node {
+	t.Helper()
+	n, err := NewNode(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.regression = regression
+	n.maxWait = time.Second
+	n.time = n.now() + lag
+	return n
+}
+
+func TestGenerateCountsRegressionOnce(t *testing.T) {
+	n := laggingNode(t, ClockLogical, 1000)
+	before := ClockRegressions.Value()
+	var last ID
+	for i := 0; i < 10; i++ {
+		id, err := n.Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id <= last {
+			t.Fatalf("id %d is not after %d", id, last)
+		}
+		last = id
+	}
+	if d := ClockRegressions.Value() - before; d != 1 {
+		t.Fatalf("expected one regression to be counted, got %d", d)
+	}
+}
+
+func TestGenerateRefusesWhileLagging(t *testing.T) {
+	n := laggingNode(t, ClockRefuse, 1000)
+	if _, err := n.Generate(); err != ErrClockRegression {
+		t.Fatalf("expected ErrClockRegression, got %v", err)
+	}
+
+	n = laggingNode(t, ClockWait, 10000)
+	if _, err := n.Generate(); !errors.Is(err, ErrClockRegression) {
+		t.Fatalf("expected a lag beyond max wait to be refused, got %v", err)
+	}
+}
+
+func TestGenerateWaitsWithoutLock(t *testing.T) {
+	n := laggingNode(t, ClockWait, 200)
+	mark := n.time
+	done := make(chan ID)
+	go func() {
+		id, err := n.Generate()
+		if err != nil {
+			t.Error(err)
+		}
+		done <- id
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if !n.mu.TryLock() {
+		t.Fatal("expected the node to be unlocked while waiting for the clock")
+	}
+	n.mu.Unlock()
+
+	select {
+	case id := <-done:
+		if id.Time()-Epoch < mark {
+			t.Fatalf("id time %d is before the mark %d", id.Time()-Epoch, mark)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("node does not wait for the clock to catch up")
+	}
+}
+
+func TestHighWaterMark(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "id.mark")
+	n, err := NewNode(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.loadHighWater(file); err != nil {
+		t.Fatal(err)
+	}
+	id, err := n.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != strconv.FormatInt(id.Time()-Epoch+highWaterLease, 10) {
+		t.Fatalf("expected the mark to lease ahead of id, got %s", b)
+	}
+
+	n.Close()
+	restarted, err := NewNode(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.loadHighWater(file); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.time != id.Time()-Epoch+1 {
+		t.Fatalf("expected restart after the last id, got %d", restarted.time)
+	}
+	if _, err := os.Stat(file + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("expected no temporary file left, got %v", err)
+	}
+}
+
+func TestGenerateWaitsForLeaseAfterRestart(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "id.mark")
+	n, err := NewNode(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mark := n.now() + 200
+	if err := ioutil.WriteFile(file, []byte(strconv.FormatInt(mark, 10)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.loadHighWater(file); err != nil {
+		t.Fatal(err)
+	}
+	n.regression = ClockRefuse
+
+	before := ClockRegressions.Value()
+	id, err := n.Generate()
+	if err != nil {
+		t.Fatalf("expected a restart within the lease to wait, got %v", err)
+	}
+	if id.Time()-Epoch < mark {
+		t.Fatalf("id time %d is before the mark %d", id.Time()-Epoch, mark)
+	}
+	if d := ClockRegressions.Value() - before; d != 0 {
+		t.Fatalf("expected no regression to be counted, got %d", d)
+	}
+
+	n.time = n.now() + 2*highWaterLease
+	if _, err := n.Generate(); err != ErrClockRegression {
+		t.Fatalf("expected a lag beyond the lease to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	. "hermes/core"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var dedup *dedupSet
+
+/**
+dedupSet remembers the event ids of the accepted logs for the dedup window.
+An event id is reserved while its batch is delivered so that a retry racing
+with the first attempt is dropped too, and released when the delivery fails
+so that the next retry goes through.
+
+Confirmed ids are appended to the file without syncing it, the ids of the
+last moments before a crash may be forgotten. The logs table deduplicates
+them by event id and the queries read it with FINAL, only the tag catalog
+counts them twice.
+*/
+type dedupSet struct {
+	mu        sync.Mutex
+	window    time.Duration
+	seen      map[string]time.Time
+	reserved  map[string]bool
+	file      *os.File
+	path      string
+	lines     int
+	nextSweep time.Time
+}
+
+func openDedupSet(c DedupConfig) (*dedupSet, error) {
+	d := &dedupSet{
+		window:    c.Window,
+		seen:      make(map[string]time.Time),
+		reserved:  make(map[string]bool),
+		path:      c.File,
+		nextSweep: time.Now().Add(time.Minute),
+	}
+	if StrIsEmpty(d.path) {
+		return d, nil
+	}
+
+	f, err := os.Open(d.path)
+	if err == nil {
+		now := time.Now()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			parts := strings.SplitN(scanner.Text(), " ", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			expiry, err := strconv.ParseInt(parts[0], 10, 64)
+			if err != nil {
+				continue
+			}
+			key, err := strconv.Unquote(parts[1])
+			if err != nil {
+				continue
+			}
+			if t := time.Unix(0, expiry); t.After(now) {
+				d.seen[key] = t
+			}
+		}
+		err = scanner.Err()
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read dedup file get error %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("open dedup file get error %v", err)
+	}
+
+	if err := d.compact(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func dedupKey(v InputLogPayload) string {
+	return v.Tag + "\x00" + v.EventId
+}
+
+/**
+reserve drops the logs whose event id is seen or reserved, including the ones
+repeated within the batch, and reserves the others. It returns the kept logs,
+their reserved keys and the number of dropped logs.
+*/
+func (d *dedupSet) reserve(inputs []InputLogPayload) ([]InputLogPayload, []string, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	if now.After(d.nextSweep) {
+		d.sweep(now)
+	}
+
+	kept := make([]InputLogPayload, 0, len(inputs))
+	keys := make([]string, 0)
+	duplicates := 0
+	for _, v := range inputs {
+		if StrIsEmpty(v.EventId) {
+			kept = append(kept, v)
+			continue
+		}
+		key := dedupKey(v)
+		if expiry, ok := d.seen[key]; (ok && expiry.After(now)) || d.reserved[key] {
+			duplicates++
+			continue
+		}
+		d.reserved[key] = true
+		keys = append(keys, key)
+		kept = append(kept, v)
+	}
+	return kept, keys, duplicates
+}
+
+func (d *dedupSet) confirm(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	expiry := time.Now().Add(d.window)
+	var b strings.Builder
+	for _, key := range keys {
+		delete(d.reserved, key)
+		d.seen[key] = expiry
+		_, _ = fmt.Fprintf(&b, "%d %s\n", expiry.UnixNano(), strconv.Quote(key))
+	}
+	if d.file == nil {
+		return
+	}
+	if _, err := d.file.WriteString(b.String()); err != nil {
+		log.Printf("write dedup file get error %v\n", err)
+		return
+	}
+	d.lines += len(keys)
+}
+
+func (d *dedupSet) release(keys []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, key := range keys {
+		delete(d.reserved, key)
+	}
+}
+
+/**
+sweep forgets the expired ids and rewrites the file once most of its lines
+are expired.
+*/
+func (d *dedupSet) sweep(now time.Time) {
+	for key, expiry := range d.seen {
+		if !expiry.After(now) {
+			delete(d.seen, key)
+		}
+	}
+	d.nextSweep = now.Add(time.Minute)
+	if d.file != nil && d.lines > 2*len(d.seen)+1024 {
+		if err := d.compact(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+/**
+compact writes the seen ids to a new file which then replaces the old one.
+*/
+func (d *dedupSet) compact() error {
+	tmp := d.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("create dedup file get error %v", err)
+	}
+	w := bufio.NewWriter(f)
+	for key, expiry := range d.seen {
+		_, _ = fmt.Fprintf(w, "%d %s\n", expiry.UnixNano(), strconv.Quote(key))
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Close()
+	} else {
+		_ = f.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp, d.path)
+	}
+	if err != nil {
+		return fmt.Errorf("write dedup file get error %v", err)
+	}
+
+	if d.file != nil {
+		_ = d.file.Close()
+	}
+	d.file, err = os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		d.file = nil
+		return fmt.Errorf("open dedup file get error %v", err)
+	}
+	d.lines = len(d.seen)
+	return nil
+}
+
+func (d *dedupSet) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.file != nil {
+		_ = d.file.Close()
+		d.file = nil
+	}
+}
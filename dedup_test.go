@@ -0,0 +1,90 @@
+package main
+
+import (
+	. "hermes/core"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func dedupInputs(eventIds ...string) []InputLogPayload {
+	inputs := make([]InputLogPayload, len(eventIds))
+	for i, id := range eventIds {
+		inputs[i] = InputLogPayload{Tag: "web", EventId: id}
+	}
+	return inputs
+}
+
+func TestDedupReserve(t *testing.T) {
+	d, err := openDedupSet(DedupConfig{Window: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.close()
+
+	kept, keys, duplicates := d.reserve(dedupInputs("a", "", "b", "a", ""))
+	if len(kept) != 4 || len(keys) != 2 || duplicates != 1 {
+		t.Fatalf("expected 4 kept logs, 2 keys and 1 duplicate, got %d, %d and %d", len(kept), len(keys), duplicates)
+	}
+
+	/** a retry racing with the first attempt is dropped */
+	kept, _, duplicates = d.reserve(dedupInputs("a", "c"))
+	if len(kept) != 1 || kept[0].EventId != "c" || duplicates != 1 {
+		t.Fatalf("expected reserved event id to be dropped, got %+v", kept)
+	}
+
+	other := []InputLogPayload{{Tag: "billing", EventId: "a"}}
+	if kept, _, _ := d.reserve(other); len(kept) != 1 {
+		t.Fatal("expected event ids to be deduplicated per tag")
+	}
+}
+
+func TestDedupConfirmAndRelease(t *testing.T) {
+	d, err := openDedupSet(DedupConfig{Window: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.close()
+
+	_, confirmed, _ := d.reserve(dedupInputs("a"))
+	_, released, _ := d.reserve(dedupInputs("b"))
+	d.confirm(confirmed)
+	d.release(released)
+
+	kept, keys, duplicates := d.reserve(dedupInputs("a", "b"))
+	if len(kept) != 1 || kept[0].EventId != "b" || duplicates != 1 {
+		t.Fatalf("expected confirmed id to be dropped and released one to be kept, got %+v", kept)
+	}
+	d.release(keys)
+
+	d.sweep(time.Now().Add(2 * time.Minute))
+	if kept, _, _ := d.reserve(dedupInputs("a")); len(kept) != 1 {
+		t.Fatal("expected id to be forgotten after the window")
+	}
+}
+
+func TestDedupReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dedup")
+	d, err := openDedupSet(DedupConfig{Window: time.Minute, File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, keys, _ := d.reserve(dedupInputs("a", "quoted \"id\"\n"))
+	d.confirm(keys)
+	_, keys, _ = d.reserve(dedupInputs("b"))
+	d.release(keys)
+	d.close()
+
+	d, err = openDedupSet(DedupConfig{Window: time.Minute, File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.close()
+	kept, _, duplicates := d.reserve(dedupInputs("a", "quoted \"id\"\n", "b"))
+	if len(kept) != 1 || kept[0].EventId != "b" || duplicates != 2 {
+		t.Fatalf("expected confirmed ids to survive a restart, got %+v", kept)
+	}
+	if d.lines != 2 {
+		t.Fatalf("expected the file to be compacted to 2 lines, got %d", d.lines)
+	}
+}
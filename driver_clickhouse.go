@@ -9,23 +9,40 @@ import (
 	"log"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type DriverClickHouse struct {
-	Pool *CHPool
+	Pool    *CHPool
+	Batcher *Batcher
 }
 
 func init() {
 	drivers["clickhouse"] = &DriverClickHouse{}
 }
 
-func (d *DriverClickHouse) Open(config DriverConfig) (err error) {
-	minActiveConn := 0
-	maxActiveConn := 1
-	maxInActiveTime := int64(300000)
+type clickHouseOptions struct {
+	minActiveConn   int
+	maxActiveConn   int
+	maxInActiveTime int64
+	flushRows       int
+	flushInterval   int64
+	autoMigrate     bool
+	dbAddress       string
+	dbOptions       []string
+}
+
+func parseClickHouseOptions(config DriverConfig) (o clickHouseOptions, err error) {
+	o = clickHouseOptions{
+		minActiveConn:   0,
+		maxActiveConn:   1,
+		maxInActiveTime: int64(300000),
+		flushRows:       DefaultFlushRows,
+		flushInterval:   int64(DefaultFlushInterval / time.Millisecond),
+		autoMigrate:     true,
+		dbOptions:       make([]string, 0),
+	}
 
-	dbAddress := ""
-	dbOptions := make([]string, 0)
 	for _, opt := range config.Options {
 		parts := strings.Split(opt, "=")
 		if len(parts) < 2 {
@@ -37,52 +54,126 @@ func (d *DriverClickHouse) Open(config DriverConfig) (err error) {
 		value := strings.Join(parts[1:], "=")
 		switch key {
 		case "minActiveConn":
-			minActiveConn, err = strconv.Atoi(value)
+			o.minActiveConn, err = strconv.Atoi(value)
 			if err != nil {
 				return
 			}
 			break
 		case "maxActiveConn":
-			maxActiveConn, err = strconv.Atoi(value)
+			o.maxActiveConn, err = strconv.Atoi(value)
 			if err != nil {
 				return
 			}
 			break
 		case "maxInActiveTime":
-			maxInActiveTime, err = strconv.ParseInt(value, 10, 64)
+			o.maxInActiveTime, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return
+			}
+			break
+		case "flushRows":
+			o.flushRows, err = strconv.Atoi(value)
+			if err != nil {
+				return
+			}
+			break
+		case "flushInterval":
+			o.flushInterval, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return
+			}
+			break
+		case "autoMigrate":
+			o.autoMigrate, err = strconv.ParseBool(value)
 			if err != nil {
 				return
 			}
 			break
 		case "address":
-			dbAddress = value
+			o.dbAddress = value
 			break
 		case "dsnopts":
-			dbOptions = append(dbOptions, value)
+			o.dbOptions = append(o.dbOptions, value)
 			break
 		default:
 			break
 		}
 	}
 
-	if StrIsEmpty(dbAddress) {
+	if StrIsEmpty(o.dbAddress) {
 		err = errors.New("missing address of clickhouse database")
 		return
 	}
+	return
+}
 
-	dsn := fmt.Sprintf("tcp://%s", dbAddress)
-	if len(dbOptions) > 0 {
-		dsn = fmt.Sprintf("tcp://%s?%s", dbAddress, strings.Join(dbOptions, "&"))
+func (o clickHouseOptions) dsn() string {
+	if len(o.dbOptions) > 0 {
+		return fmt.Sprintf("tcp://%s?%s", o.dbAddress, strings.Join(o.dbOptions, "&"))
+	}
+	return fmt.Sprintf("tcp://%s", o.dbAddress)
+}
+
+/**
+adminDsn leaves the database out of the dsn since it may not exist yet.
+*/
+func (o clickHouseOptions) adminDsn() string {
+	opts := make([]string, 0, len(o.dbOptions))
+	for _, v := range o.dbOptions {
+		if !strings.HasPrefix(v, "database=") {
+			opts = append(opts, v)
+		}
+	}
+	if len(opts) > 0 {
+		return fmt.Sprintf("tcp://%s?%s", o.dbAddress, strings.Join(opts, "&"))
 	}
+	return fmt.Sprintf("tcp://%s", o.dbAddress)
+}
+
+func (d *DriverClickHouse) Open(config DriverConfig) (err error) {
+	o, err := parseClickHouseOptions(config)
+	if err != nil {
+		return
+	}
+
+	if o.autoMigrate {
+		err = Migrate(o.adminDsn(), false)
+		if err != nil {
+			return
+		}
+	}
+
+	dsn := o.dsn()
 	log.Printf("clickhouse dsn %s\n", dsn)
-	d.Pool, err = CreateCHPool(minActiveConn, maxActiveConn, maxInActiveTime, dsn)
+	d.Pool, err = CreateCHPool(o.minActiveConn, o.maxActiveConn, o.maxInActiveTime, dsn)
+	if err != nil {
+		return
+	}
+	d.Batcher, err = CreateBatcher(dsn, o.flushRows, time.Duration(o.flushInterval)*time.Millisecond)
 	if err != nil {
 		return
 	}
 	return
 }
 
-func (d *DriverClickHouse) Collect(messages []InputLogPayload) error {
+func (d *DriverClickHouse) ApplyRetention(r RetentionConfig) error {
+	c, err := d.Pool.Acquire()
+	if err != nil {
+		return err
+	}
+
+	if c == nil {
+		return errors.New("can not acquire connection")
+	}
+
+	defer func() {
+		_ = d.Pool.Release(c)
+	}()
+
+	return c.ApplyRetention(r.Rules())
+}
+
+func (d *DriverClickHouse) CheckIdLayout(layout IdConfig) error {
 	c, err := d.Pool.Acquire()
 	if err != nil {
 		return err
@@ -96,10 +187,36 @@ func (d *DriverClickHouse) Collect(messages []InputLogPayload) error {
 		_ = d.Pool.Release(c)
 	}()
 
+	return c.CheckIdLayout(layout)
+}
+
+func (d *DriverClickHouse) Migrate(config DriverConfig) error {
+	o, err := parseClickHouseOptions(config)
+	if err != nil {
+		return err
+	}
+	return Migrate(o.adminDsn(), true)
+}
+
+/**
+Collect hands the messages to the batcher and waits until the block holding
+them is written.
+*/
+func (d *DriverClickHouse) Collect(messages []InputLogPayload) error {
 	entries := make([]LogEntry, len(messages))
 
 	for i, v := range messages {
+		id, err := NextId()
+		if err != nil {
+			return err
+		}
+		eventId := v.EventId
+		if StrIsEmpty(eventId) {
+			eventId = strconv.FormatInt(id, 10)
+		}
 		entries[i] = LogEntry{
+			Id:            id,
+			EventId:       eventId,
 			Tag:           v.Tag,
 			Timestamp:     v.Timestamp,
 			ContainerName: v.ContainerName,
@@ -110,7 +227,7 @@ func (d *DriverClickHouse) Collect(messages []InputLogPayload) error {
 		}
 	}
 
-	return c.Insert(entries)
+	return d.Batcher.Add(entries)
 }
 
 func (d *DriverClickHouse) FindAllTag(ctx context.Context) ([]string, error) {
@@ -130,7 +247,146 @@ func (d *DriverClickHouse) FindAllTag(ctx context.Context) ([]string, error) {
 	return c.GetAllTags(ctx)
 }
 
+func (d *DriverClickHouse) TagCatalog(ctx context.Context, days int) ([]TagInfo, error) {
+	c, err := d.Pool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	if c == nil {
+		return nil, errors.New("can not acquire connection")
+	}
+
+	defer func() {
+		_ = d.Pool.Release(c)
+	}()
+
+	return c.GetCatalog(ctx, days)
+}
+
+func (d *DriverClickHouse) FindContainers(ctx context.Context, opt QueryLogOption) ([]ContainerCount, error) {
+	c, err := d.Pool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	if c == nil {
+		return nil, errors.New("can not acquire connection")
+	}
+
+	defer func() {
+		_ = d.Pool.Release(c)
+	}()
+
+	return c.GetContainers(ctx, opt)
+}
+
+func (d *DriverClickHouse) ContextKeys(ctx context.Context, opt ContextOption) ([]StatsGroup, error) {
+	c, err := d.Pool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	if c == nil {
+		return nil, errors.New("can not acquire connection")
+	}
+
+	defer func() {
+		_ = d.Pool.Release(c)
+	}()
+
+	return c.GetContextKeys(ctx, opt)
+}
+
+func (d *DriverClickHouse) ContextValues(ctx context.Context, opt ContextOption) ([]StatsGroup, error) {
+	c, err := d.Pool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	if c == nil {
+		return nil, errors.New("can not acquire connection")
+	}
+
+	defer func() {
+		_ = d.Pool.Release(c)
+	}()
+
+	return c.GetContextValues(ctx, opt)
+}
+
+func (d *DriverClickHouse) FindLog(ctx context.Context, id int64) (OutputLogPayload, error) {
+	c, err := d.Pool.Acquire()
+	if err != nil {
+		return OutputLogPayload{}, err
+	}
+
+	if c == nil {
+		return OutputLogPayload{}, errors.New("can not acquire connection")
+	}
+
+	defer func() {
+		_ = d.Pool.Release(c)
+	}()
+
+	return c.GetEntry(ctx, id, "")
+}
+
+func (d *DriverClickHouse) FindSurrounding(ctx context.Context, opt SurroundingOption) ([]OutputLogPayload, error) {
+	c, err := d.Pool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	if c == nil {
+		return nil, errors.New("can not acquire connection")
+	}
+
+	defer func() {
+		_ = d.Pool.Release(c)
+	}()
+
+	return c.GetSurrounding(ctx, opt)
+}
+
+func (d *DriverClickHouse) Histogram(ctx context.Context, opt HistogramOption) ([]HistogramBucket, error) {
+	c, err := d.Pool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	if c == nil {
+		return nil, errors.New("can not acquire connection")
+	}
+
+	defer func() {
+		_ = d.Pool.Release(c)
+	}()
+
+	return c.GetHistogram(ctx, opt)
+}
+
+func (d *DriverClickHouse) Stats(ctx context.Context, opt StatsOption) (LogStats, error) {
+	c, err := d.Pool.Acquire()
+	if err != nil {
+		return LogStats{}, err
+	}
+
+	if c == nil {
+		return LogStats{}, errors.New("can not acquire connection")
+	}
+
+	defer func() {
+		_ = d.Pool.Release(c)
+	}()
+
+	return c.GetStats(ctx, opt)
+}
+
 func (d *DriverClickHouse) Close() error {
+	if d.Batcher != nil {
+		_ = d.Batcher.Close()
+	}
 	return d.Pool.Close()
 }
 
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"flag"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
@@ -14,7 +16,9 @@ import (
 var version = "1.0.0"
 var config HermesConfig
 var drivers = make(map[string]LogDriver)
+var activeDrivers = make(map[string]LogDriver)
 var mainStorage LogDriver
+var mainStorageName string
 
 func main() {
 	log.SetOutput(os.Stdout)
@@ -38,12 +42,6 @@ func main() {
 		webRoot = directory
 	}
 
-	/** init id generator */
-	err = InitIdGenerator(nodeId)
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	/** init working directory and read configuration */
 	workDir, err := filepath.Abs(".")
 	if err != nil {
@@ -61,6 +59,18 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if flag.Arg(0) == "migrate" {
+		migrate()
+		return
+	}
+
+	/** init id generator */
+	err = InitIdGenerator(nodeId, config.Id)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer SnowFlake.Close()
+
 	/** init drivers */
 	for _, opt := range config.Drivers {
 		driver, ok := drivers[opt.Name]
@@ -71,24 +81,84 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
+		activeDrivers[opt.Name] = driver
 		if opt.IsMainStorage {
 			if mainStorage != nil {
 				log.Fatalln("found two driver are configured as main storage")
 			}
 			mainStorage = driver
+			mainStorageName = opt.Name
+		}
+	}
+
+	if mainStorage == nil {
+		log.Fatalln("not found any driver is configured as main storage")
+	}
+
+	/** refuse an id layout that does not fit the stored logs */
+	for name, driver := range activeDrivers {
+		checker, ok := driver.(IdLayoutChecker)
+		if !ok {
+			continue
+		}
+		err = checker.CheckIdLayout(config.Id)
+		if err != nil {
+			log.Fatalf("driver %s: %v\n", name, err)
+		}
+	}
+
+	/** enforce retention */
+	for name, driver := range activeDrivers {
+		enforcer, ok := driver.(RetentionEnforcer)
+		if !ok {
+			log.Printf("driver %s does not enforce retention\n", name)
+			continue
+		}
+		err = enforcer.ApplyRetention(config.Retention)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	/** init write-ahead log or driver queues */
+	ctx, cancel := context.WithCancel(context.Background())
+	err = openWriteAheadLog(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if writeAheadLog == nil {
+		for _, opt := range config.Drivers {
+			q, err := openDriverQueue(ctx, opt, activeDrivers[opt.Name])
+			if err != nil {
+				log.Fatal(err)
+			}
+			driverQueues[opt.Name] = q
+		}
+	}
+
+	if config.Ingest.Dedup.Window > 0 {
+		dedup, err = openDedupSet(config.Ingest.Dedup)
+		if err != nil {
+			log.Fatal(err)
 		}
 	}
 
 	defer func() {
-		for _, driver := range drivers {
+		cancel()
+		if dedup != nil {
+			dedup.close()
+		}
+		if writeAheadLog != nil {
+			_ = writeAheadLog.Close()
+		}
+		for _, q := range driverQueues {
+			q.close()
+		}
+		for _, driver := range activeDrivers {
 			_ = driver.Close()
 		}
 	}()
 
-	if mainStorage == nil {
-		log.Fatalln("not found any driver is configured as main storage")
-	}
-
 	router := httprouter.New()
 	router.GlobalOPTIONS = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get("Access-Control-Request-Method") != "" {
@@ -109,7 +179,20 @@ func main() {
 
 	router.POST("/cluster", clusterCommand)
 	router.POST("/api/log", collectLog)
+	router.GET("/api/log", queryLog)
+	router.GET("/api/log/:id", retrieveLog)
+	router.GET("/api/log/:id/surrounding", retrieveSurrounding)
+	router.POST("/api/query", queryLogByBody)
 	router.GET("/api/tag", retrieveListOfTag)
+	router.GET("/api/tag/catalog", retrieveTagCatalog)
+	router.GET("/api/container", retrieveListOfContainer)
+	router.GET("/api/context/key", retrieveListOfContextKey)
+	router.GET("/api/context/value", retrieveListOfContextValue)
+	router.GET("/api/histogram", retrieveHistogram)
+	router.GET("/api/stats", retrieveStats)
+	router.GET("/api/admin/retention", retrieveRetention)
+	router.GET("/api/admin/id/:id", explainId)
+	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
 	router.GET("/ws", webSocket)
 	router.GET("/web", webInterface)
 
@@ -143,3 +226,25 @@ func main() {
 	}
 	log.Fatal(http.ListenAndServeTLS(fmt.Sprintf(":%d", port), certPem, keyPerm, nil))
 }
+
+/**
+migrate applies the schema migrations of every configured driver and exits.
+*/
+func migrate() {
+	for _, opt := range config.Drivers {
+		driver, ok := drivers[opt.Name]
+		if !ok || driver == nil {
+			log.Fatal(fmt.Errorf("not found driver with name %s", opt.Name))
+		}
+		migrator, ok := driver.(SchemaMigrator)
+		if !ok {
+			log.Printf("driver %s has no schema to migrate\n", opt.Name)
+			continue
+		}
+		err := migrator.Migrate(opt)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("schema of driver %s is up to date\n", opt.Name)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	. "hermes/core"
+	"strings"
+)
+
+const (
+	OrderAsc  = "asc"
+	OrderDesc = "desc"
+)
+
+/**
+LogQuery is the query a client sends over the WebSocket or to /api/log.
+LastId (and LastTimestamp if known) is the keyset of the row to continue from,
+see QueryLogOption.
+*/
+type LogQuery struct {
+	Tag           string `json:"tag"`
+	LogLevel      int32  `json:"level"`
+	TimeOption    `json:"time"`
+	Limit         int32  `json:"limit,omitempty"`
+	Order         string `json:"order,omitempty"`
+	LastId        string `json:"last_id,omitempty"`
+	LastTimestamp int64  `json:"last_timestamp,omitempty"`
+	Backward      bool   `json:"backward,omitempty"`
+
+	Message []MessageFilter `json:"message,omitempty"`
+	Context []ContextFilter `json:"context,omitempty"`
+
+	Containers        []string `json:"containers,omitempty"`
+	ExcludeContainers []string `json:"exclude_containers,omitempty"`
+
+	// Credits is the number of batches a WebSocket client accepts before it
+	// sends more credits, zero means no flow control
+	Credits int64 `json:"credits,omitempty"`
+}
+
+type TimeOption struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+func (q LogQuery) option(batchSize int32, response chan OutputLogMessage) (opt QueryLogOption, err error) {
+	if StrIsEmpty(q.Tag) {
+		err = errors.New("missing tag in query option")
+		return
+	}
+	return q.filter(batchSize, response)
+}
+
+/**
+filter is option without a required tag, for the aggregations that may span
+every tag.
+*/
+func (q LogQuery) filter(batchSize int32, response chan OutputLogMessage) (opt QueryLogOption, err error) {
+	if q.Limit < 0 {
+		err = errors.New("limit must not be negative")
+		return
+	}
+	if q.Backward && q.Limit == 0 {
+		err = errors.New("backward query needs a limit")
+		return
+	}
+
+	opt = QueryLogOption{
+		Tag:           q.Tag,
+		LogLevel:      q.LogLevel,
+		StartTime:     q.Start,
+		EndTime:       q.End,
+		LastTimestamp: q.LastTimestamp,
+		Limit:         q.Limit,
+		Backward:      q.Backward,
+		BatchSize:     batchSize,
+		Response:      response,
+	}
+
+	switch strings.ToLower(q.Order) {
+	case "", OrderAsc:
+		break
+	case OrderDesc:
+		opt.Descending = true
+		break
+	default:
+		err = fmt.Errorf("order %s is not supported", q.Order)
+		return
+	}
+
+	for i := range q.Message {
+		if err = q.Message[i].Validate(); err != nil {
+			return
+		}
+	}
+	opt.Message = q.Message
+
+	for i := range q.Context {
+		if err = q.Context[i].Validate(); err != nil {
+			return
+		}
+	}
+	opt.Context = q.Context
+	opt.Containers = q.Containers
+	opt.ExcludeContainers = q.ExcludeContainers
+
+	if !StrIsEmpty(q.LastId) {
+		opt.LastId, err = parseLogId(q.LastId)
+		if err != nil {
+			err = fmt.Errorf("last_id %s is not valid", q.LastId)
+			return
+		}
+	}
+	return
+}
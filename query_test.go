@@ -0,0 +1,27 @@
+package main
+
+import (
+	. "hermes/core"
+	"testing"
+)
+
+func TestLogQueryLastIdEncodings(t *testing.T) {
+	node, err := NewNode(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := node.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []string{id.String(), id.Base58(), id.Base32(), " " + id.Base58() + " "} {
+		opt, err := LogQuery{Tag: "web", LastId: v}.option(10, nil)
+		if err != nil {
+			t.Fatalf("last_id %q get error %v", v, err)
+		}
+		if opt.LastId != id.Int64() {
+			t.Fatalf("last_id %q is parsed to %d, expected %d", v, opt.LastId, id.Int64())
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	. "hermes/core"
+	"hermes/wal"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+var (
+	errQueueFull    = errors.New("queue is full")
+	errBatchDropped = errors.New("batch is dropped since queue is full")
+)
+
+var driverQueues = make(map[string]*driverQueue)
+
+/**
+maxMergedLogs caps how many logs of queued batches a worker merges into one
+Collect call.
+*/
+const maxMergedLogs = 100000
+
+/**
+driverQueue decouples a driver from the ingest requests. Every driver owns a
+bounded queue of batches drained by its own workers, so a slow driver only
+delays itself.
+*/
+type driverQueue struct {
+	name         string
+	driver       LogDriver
+	main         bool
+	overflow     string
+	blockTimeout time.Duration
+	items        chan *queueItem
+	spill        *wal.Log
+}
+
+type queueItem struct {
+	inputs []InputLogPayload
+	done   chan error
+}
+
+func (i *queueItem) finish(err error) {
+	if i.done != nil {
+		i.done <- err
+	}
+}
+
+func openDriverQueue(ctx context.Context, opt DriverConfig, driver LogDriver) (*driverQueue, error) {
+	q := &driverQueue{
+		name:         opt.Name,
+		driver:       driver,
+		main:         opt.IsMainStorage,
+		overflow:     opt.Queue.Overflow,
+		blockTimeout: opt.Queue.BlockTimeout,
+		items:        make(chan *queueItem, opt.Queue.Size),
+	}
+
+	if q.overflow == OverflowSpill {
+		spill, err := wal.Open(wal.Options{
+			Dir:     filepath.Join(opt.Queue.SpillDir, opt.Name),
+			MaxSize: opt.Queue.SpillMaxSize,
+			MaxAge:  opt.Queue.SpillMaxAge,
+			NoSync:  config.Wal.NoSync,
+		})
+		if err != nil {
+			return nil, err
+		}
+		cursor, err := spill.Cursor("queue")
+		if err != nil {
+			_ = spill.Close()
+			return nil, err
+		}
+		q.spill = spill
+		go q.drainSpill(ctx, cursor)
+	}
+
+	for i := 0; i < opt.Queue.Workers; i++ {
+		go q.work(ctx)
+	}
+	return q, nil
+}
+
+func (q *driverQueue) work(ctx context.Context) {
+	for {
+		select {
+		case item := <-q.items:
+			items := []*queueItem{item}
+			inputs := item.inputs
+			for merging := true; merging && len(inputs) < maxMergedLogs; {
+				select {
+				case next := <-q.items:
+					items = append(items, next)
+					inputs = append(inputs[:len(inputs):len(inputs)], next.inputs...)
+				default:
+					merging = false
+				}
+			}
+			err := q.driver.Collect(inputs)
+			if err != nil {
+				log.Printf("collect log in driver %s get error %v \n", q.name, err)
+			}
+			for _, i := range items {
+				i.finish(err)
+			}
+			break
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+/**
+drainSpill replays the batches that overflowed to disk.
+*/
+func (q *driverQueue) drainSpill(ctx context.Context, cursor *wal.Cursor) {
+	for {
+		data, pos, err := cursor.Next(ctx)
+		if err != nil {
+			if err == wal.ErrClosed || ctx.Err() != nil {
+				return
+			}
+			log.Printf("read spill of driver %s get error %v\n", q.name, err)
+			time.Sleep(config.Wal.RetryInterval)
+			continue
+		}
+		var inputs []InputLogPayload
+		if err := json.Unmarshal(data, &inputs); err != nil {
+			log.Printf("can not unmarshal spilled batch of driver %s. Skip it. %v\n", q.name, err)
+		} else if !collectWithRetry(ctx, q.name, q.driver, inputs) {
+			return
+		}
+		if err := cursor.Commit(pos); err != nil {
+			log.Printf("commit spill cursor of driver %s get error %v\n", q.name, err)
+		}
+	}
+}
+
+/**
+push enqueues the item according to the overflow policy of the queue. Items
+that end up on disk are finished right away since the spill is durable. Under
+the block policy the queue of a driver other than the main storage is waited
+for until the request is gone or the block timeout expires.
+*/
+func (q *driverQueue) push(ctx context.Context, item *queueItem) error {
+	select {
+	case q.items <- item:
+		return nil
+	default:
+	}
+
+	switch q.overflow {
+	case OverflowDropOldest:
+		for {
+			select {
+			case q.items <- item:
+				return nil
+			default:
+			}
+			select {
+			case old := <-q.items:
+				log.Printf("queue of driver %s is full. Drop oldest batch of %d logs\n", q.name, len(old.inputs))
+				old.finish(errBatchDropped)
+			default:
+			}
+		}
+	case OverflowSpill:
+		data, err := json.Marshal(item.inputs)
+		if err != nil {
+			return err
+		}
+		_, err = q.spill.Append(data)
+		if err != nil {
+			return err
+		}
+		item.finish(nil)
+		return nil
+	default:
+		if q.main {
+			return errQueueFull
+		}
+		timer := time.NewTimer(q.blockTimeout)
+		defer timer.Stop()
+		select {
+		case q.items <- item:
+			return nil
+		case <-timer.C:
+			return errQueueFull
+		case <-ctx.Done():
+			return errQueueFull
+		}
+	}
+}
+
+func (q *driverQueue) close() {
+	if q.spill != nil {
+		_ = q.spill.Close()
+	}
+}
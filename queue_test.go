@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	. "hermes/core"
+	"testing"
+	"time"
+)
+
+type recordingDriver struct {
+	LogDriver
+	batches chan []InputLogPayload
+}
+
+func (d *recordingDriver) Collect(messages []InputLogPayload) error {
+	d.batches <- messages
+	return nil
+}
+
+func newTestQueue(main bool, overflow string) *driverQueue {
+	return &driverQueue{
+		name:         "test",
+		main:         main,
+		overflow:     overflow,
+		blockTimeout: 20 * time.Millisecond,
+		items:        make(chan *queueItem, 1),
+	}
+}
+
+func testItem(message string) *queueItem {
+	return &queueItem{inputs: []InputLogPayload{{Message: message}}, done: make(chan error, 1)}
+}
+
+func TestPushBlockRejectsMainWhenFull(t *testing.T) {
+	q := newTestQueue(true, OverflowBlock)
+	if err := q.push(context.Background(), testItem("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.push(context.Background(), testItem("b")); err != errQueueFull {
+		t.Fatalf("expected errQueueFull, got %v", err)
+	}
+}
+
+func TestPushBlockWaitsForSecondary(t *testing.T) {
+	q := newTestQueue(false, OverflowBlock)
+	q.blockTimeout = time.Second
+	if err := q.push(context.Background(), testItem("a")); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-q.items
+	}()
+	if err := q.push(context.Background(), testItem("b")); err != nil {
+		t.Fatalf("expected push to wait for room, got %v", err)
+	}
+}
+
+func TestPushBlockBoundsSecondary(t *testing.T) {
+	q := newTestQueue(false, OverflowBlock)
+	if err := q.push(context.Background(), testItem("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.push(context.Background(), testItem("b")); err != errQueueFull {
+		t.Fatalf("expected errQueueFull after the block timeout, got %v", err)
+	}
+
+	q.blockTimeout = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := q.push(ctx, testItem("c")); err != errQueueFull {
+		t.Fatalf("expected errQueueFull once the request is gone, got %v", err)
+	}
+}
+
+func TestPushDropOldest(t *testing.T) {
+	q := newTestQueue(false, OverflowDropOldest)
+	old := testItem("a")
+	if err := q.push(context.Background(), old); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.push(context.Background(), testItem("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-old.done; err != errBatchDropped {
+		t.Fatalf("expected oldest batch to be dropped, got %v", err)
+	}
+	if item := <-q.items; item.inputs[0].Message != "b" {
+		t.Fatalf("expected newest batch to be queued, got %s", item.inputs[0].Message)
+	}
+}
+
+func TestPushSpillReplaysBatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	driver := &recordingDriver{batches: make(chan []InputLogPayload, 4)}
+	opt := DriverConfig{Name: "test", Queue: QueueConfig{Size: 1, Overflow: OverflowSpill, SpillDir: t.TempDir()}}
+	q, err := openDriverQueue(ctx, opt, driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.close()
+
+	if err := q.push(ctx, testItem("a")); err != nil {
+		t.Fatal(err)
+	}
+	spilled := testItem("b")
+	if err := q.push(ctx, spilled); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-spilled.done; err != nil {
+		t.Fatalf("expected spilled batch to be finished, got %v", err)
+	}
+
+	select {
+	case batch := <-driver.batches:
+		if batch[0].Message != "b" {
+			t.Fatalf("expected spilled batch to be replayed, got %s", batch[0].Message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("spilled batch is not replayed")
+	}
+}
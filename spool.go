@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	. "hermes/core"
+	"hermes/wal"
+	"log"
+	"time"
+)
+
+var writeAheadLog *wal.Log
+
+/**
+openWriteAheadLog opens the log configured in config.Wal and starts one replay
+loop per active driver. It does nothing when the log is disabled.
+*/
+func openWriteAheadLog(ctx context.Context) error {
+	if StrIsEmpty(config.Wal.Dir) {
+		return nil
+	}
+	l, err := wal.Open(wal.Options{
+		Dir:         config.Wal.Dir,
+		SegmentSize: config.Wal.SegmentSize,
+		MaxSize:     config.Wal.MaxSize,
+		MaxAge:      config.Wal.MaxAge,
+		NoSync:      config.Wal.NoSync,
+	})
+	if err != nil {
+		return err
+	}
+	for name, driver := range activeDrivers {
+		cursor, err := l.Cursor(name)
+		if err != nil {
+			_ = l.Close()
+			return err
+		}
+		go replayWriteAheadLog(ctx, name, driver, cursor)
+	}
+	writeAheadLog = l
+	log.Printf("write-ahead log is enabled in %s\n", config.Wal.Dir)
+	return nil
+}
+
+func appendWriteAheadLog(inputs []InputLogPayload) error {
+	data, err := json.Marshal(inputs)
+	if err != nil {
+		return err
+	}
+	_, err = writeAheadLog.Append(data)
+	return err
+}
+
+/**
+replayWriteAheadLog hands records to the driver and only moves the cursor once
+the driver has accepted them, retrying with an exponential delay meanwhile.
+Records that are already on disk are merged into one Collect call.
+*/
+func replayWriteAheadLog(ctx context.Context, name string, driver LogDriver, cursor *wal.Cursor) {
+	drained, cancel := context.WithCancel(ctx)
+	cancel()
+	for {
+		data, pos, err := cursor.Next(ctx)
+		if err != nil {
+			if err == wal.ErrClosed || ctx.Err() != nil {
+				return
+			}
+			log.Printf("read wal for driver %s get error %v\n", name, err)
+			time.Sleep(config.Wal.RetryInterval)
+			continue
+		}
+
+		inputs := make([]InputLogPayload, 0)
+		for {
+			var record []InputLogPayload
+			if err := json.Unmarshal(data, &record); err != nil {
+				log.Printf("can not unmarshal wal record for driver %s. Skip it. %v\n", name, err)
+			}
+			inputs = append(inputs, record...)
+			if len(inputs) >= maxMergedLogs {
+				break
+			}
+			/** a done context makes Next return only what is already on disk */
+			next, nextPos, err := cursor.Next(drained)
+			if err != nil {
+				break
+			}
+			data, pos = next, nextPos
+		}
+
+		if len(inputs) > 0 && !collectWithRetry(ctx, name, driver, inputs) {
+			return
+		}
+
+		if err := cursor.Commit(pos); err != nil {
+			log.Printf("commit wal cursor of driver %s get error %v\n", name, err)
+		}
+	}
+}
+
+/**
+collectWithRetry returns false if ctx is done before the driver accepts inputs.
+*/
+func collectWithRetry(ctx context.Context, name string, driver LogDriver, inputs []InputLogPayload) bool {
+	delay := config.Wal.RetryInterval
+	for {
+		err := driver.Collect(inputs)
+		if err == nil {
+			return true
+		}
+		log.Printf("deliver batch to driver %s get error %v. Retry in %v\n", name, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return false
+		}
+		delay *= 2
+		if delay > config.Wal.MaxRetryInterval {
+			delay = config.Wal.MaxRetryInterval
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	. "hermes/core"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	tailBufferSize    = 1000
+	tailBatchSize     = 100
+	tailFlushInterval = 200 * time.Millisecond
+)
+
+var tails = &tailHub{
+	subscribers: make(map[*tailSubscriber]struct{}),
+}
+
+/**
+tailHub hands the logs accepted by collectLog to the live tail subscribers.
+Publishing never blocks: a subscriber whose buffer is full loses the logs and
+is told how many with its next message.
+*/
+type tailHub struct {
+	sync.RWMutex
+	subscribers map[*tailSubscriber]struct{}
+}
+
+type tailSubscriber struct {
+	match   func(InputLogPayload) bool
+	buffer  chan OutputLogPayload
+	dropped uint64
+}
+
+func (h *tailHub) subscribe(match func(InputLogPayload) bool) *tailSubscriber {
+	s := &tailSubscriber{
+		match:  match,
+		buffer: make(chan OutputLogPayload, tailBufferSize),
+	}
+	h.Lock()
+	h.subscribers[s] = struct{}{}
+	h.Unlock()
+	return s
+}
+
+func (h *tailHub) unsubscribe(s *tailSubscriber) {
+	h.Lock()
+	delete(h.subscribers, s)
+	h.Unlock()
+}
+
+func (h *tailHub) publish(inputs []InputLogPayload) {
+	h.RLock()
+	defer h.RUnlock()
+	for s := range h.subscribers {
+		for _, v := range inputs {
+			if !s.match(v) {
+				continue
+			}
+			select {
+			case s.buffer <- OutputLogPayload{InputLogPayload: v}:
+			default:
+				atomic.AddUint64(&s.dropped, 1)
+			}
+		}
+	}
+}
+
+/**
+forward sends the logs of the subscriber to send in batches tagged with id
+until ctx is done.
+*/
+func (s *tailSubscriber) forward(ctx context.Context, id string, send chan []byte) {
+	t := time.NewTicker(tailFlushInterval)
+	defer t.Stop()
+	batch := make([]OutputLogPayload, 0, tailBatchSize)
+	for {
+		select {
+		case v := <-s.buffer:
+			batch = append(batch, v)
+			if len(batch) < tailBatchSize {
+				continue
+			}
+			break
+		case <-t.C:
+			break
+		case <-ctx.Done():
+			return
+		}
+
+		dropped := atomic.SwapUint64(&s.dropped, 0)
+		if len(batch) == 0 && dropped == 0 {
+			continue
+		}
+		msg := OutputTailMessage{
+			OutputMessage: OutputMessage{
+				Code:    http.StatusOK,
+				Message: "OK",
+			},
+			Data:    batch,
+			Dropped: dropped,
+		}
+		if dropped > 0 {
+			msg.Code = http.StatusPartialContent
+			msg.Message = fmt.Sprintf("gap of %d logs since the subscriber is too slow", dropped)
+		}
+		bytes, err := json.Marshal(&msg)
+		if err != nil {
+			log.Printf("error %v while marshalling batch of tail\n", err)
+			continue
+		}
+		bytes, err = json.Marshal(WSData{Topic: TopicTail, Id: id, Data: string(bytes)})
+		if err != nil {
+			log.Printf("error %v while marshalling batch of tail\n", err)
+			continue
+		}
+		select {
+		case send <- bytes:
+		case <-ctx.Done():
+			return
+		}
+		batch = make([]OutputLogPayload, 0, tailBatchSize)
+	}
+}
+
+/**
+matchLog builds the in-process equivalent of the filters a driver applies to
+a query. The time range is not used by tails.
+*/
+func matchLog(opt QueryLogOption) (func(InputLogPayload) bool, error) {
+	messages := make([]func(string) bool, 0, len(opt.Message))
+	for _, m := range opt.Message {
+		f, err := matchMessage(m)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, f)
+	}
+	includes, err := globsToRegexp(opt.Containers)
+	if err != nil {
+		return nil, err
+	}
+	excludes, err := globsToRegexp(opt.ExcludeContainers)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(v InputLogPayload) bool {
+		if v.Tag != opt.Tag || LogLevelInt(v.Level) < opt.LogLevel {
+			return false
+		}
+		if includes != nil && !includes.MatchString(v.ContainerName) {
+			return false
+		}
+		if excludes != nil && excludes.MatchString(v.ContainerName) {
+			return false
+		}
+		for _, f := range messages {
+			if !f(v.Message) {
+				return false
+			}
+		}
+		for _, c := range opt.Context {
+			if !matchContext(c, v.Context) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func matchMessage(m MessageFilter) (func(string) bool, error) {
+	var f func(string) bool
+	switch m.Mode {
+	case MatchRegex:
+		pattern := m.Pattern
+		if m.CaseInsensitive {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		f = re.MatchString
+		break
+	case MatchToken:
+		token := m.Pattern
+		if m.CaseInsensitive {
+			token = strings.ToLower(token)
+			f = func(s string) bool {
+				return hasToken(strings.ToLower(s), token)
+			}
+		} else {
+			f = func(s string) bool {
+				return hasToken(s, token)
+			}
+		}
+		break
+	default:
+		pattern := m.Pattern
+		if m.CaseInsensitive {
+			pattern = strings.ToLower(pattern)
+			f = func(s string) bool {
+				return strings.Contains(strings.ToLower(s), pattern)
+			}
+		} else {
+			f = func(s string) bool {
+				return strings.Contains(s, pattern)
+			}
+		}
+		break
+	}
+	if m.Negate {
+		return func(s string) bool {
+			return !f(s)
+		}, nil
+	}
+	return f, nil
+}
+
+/**
+hasToken finds token between separators of s like hasToken of ClickHouse, so
+that tails and stored queries agree on what a token is.
+*/
+func hasToken(s string, token string) bool {
+	for i := 0; i+len(token) <= len(s); {
+		j := strings.Index(s[i:], token)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(token)
+		if (start == 0 || IsTokenSeparator(s[start-1])) && (end == len(s) || IsTokenSeparator(s[end])) {
+			return true
+		}
+		i = start + 1
+	}
+	return false
+}
+
+func matchContext(c ContextFilter, ctx InputLogContext) bool {
+	value, ok := ctx[c.Key]
+	switch c.Op {
+	case ContextExists:
+		return ok
+	case ContextNotEquals:
+		return !ok || value != c.Value
+	case ContextIn:
+		for _, v := range c.Values {
+			if ok && value == v {
+				return true
+			}
+		}
+		return false
+	case ContextPrefix:
+		return ok && strings.HasPrefix(value, c.Value)
+	}
+	return ok && value == c.Value
+}
+
+func globsToRegexp(globs []string) (*regexp.Regexp, error) {
+	if len(globs) == 0 {
+		return nil, nil
+	}
+	patterns := make([]string, len(globs))
+	for i, glob := range globs {
+		pattern := regexp.QuoteMeta(glob)
+		pattern = strings.Replace(pattern, `\*`, `.*`, -1)
+		pattern = strings.Replace(pattern, `\?`, `.`, -1)
+		patterns[i] = "^" + pattern + "$"
+	}
+	return regexp.Compile(strings.Join(patterns, "|"))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	. "hermes/core"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMatchLog(t *testing.T) {
+	opt := QueryLogOption{
+		Tag:               "web",
+		LogLevel:          LevelWarningInt,
+		Containers:        []string{"api-*", "worker-?"},
+		ExcludeContainers: []string{"api-canary"},
+		Message: []MessageFilter{
+			{Mode: MatchSubstring, Pattern: "TIMEOUT", CaseInsensitive: true},
+			{Mode: MatchToken, Pattern: "retry", Negate: true},
+		},
+		Context: []ContextFilter{{Key: "region", Op: ContextIn, Values: []string{"eu", "us"}}},
+	}
+	match, err := matchLog(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := InputLogPayload{
+		Tag:           "web",
+		Level:         LevelError,
+		ContainerName: "api-1",
+		Message:       "upstream timeout",
+		Context:       InputLogContext{"region": "eu"},
+	}
+	if !match(base) {
+		t.Fatal("expected log to match")
+	}
+	cases := map[string]func(v *InputLogPayload){
+		"tag":              func(v *InputLogPayload) { v.Tag = "billing" },
+		"level":            func(v *InputLogPayload) { v.Level = LevelInfo },
+		"container":        func(v *InputLogPayload) { v.ContainerName = "db-1" },
+		"glob ?":           func(v *InputLogPayload) { v.ContainerName = "worker-10" },
+		"excluded":         func(v *InputLogPayload) { v.ContainerName = "api-canary" },
+		"message":          func(v *InputLogPayload) { v.Message = "upstream error" },
+		"negated token":    func(v *InputLogPayload) { v.Message = "timeout, will retry" },
+		"context value":    func(v *InputLogPayload) { v.Context = InputLogContext{"region": "ap"} },
+		"context no value": func(v *InputLogPayload) { v.Context = nil },
+	}
+	for name, change := range cases {
+		v := base
+		change(&v)
+		if match(v) {
+			t.Errorf("expected %s to exclude %+v", name, v)
+		}
+	}
+
+	v := base
+	v.ContainerName = "worker-1"
+	v.Message = "timeout retrying"
+	if !match(v) {
+		t.Fatal("expected token filter to only exclude the whole word")
+	}
+}
+
+func TestMatchLogInvalidRegex(t *testing.T) {
+	_, err := matchLog(QueryLogOption{Tag: "web", Message: []MessageFilter{{Mode: MatchRegex, Pattern: "("}}})
+	if err == nil {
+		t.Fatal("expected an invalid regex to be rejected")
+	}
+}
+
+func TestGlobsToRegexp(t *testing.T) {
+	re, err := globsToRegexp([]string{"api.*", "db-?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]bool{
+		"api.1":   true,
+		"api.":    true,
+		"apix1":   false,
+		"db-1":    true,
+		"db-10":   false,
+		"my-db-1": false,
+	} {
+		if re.MatchString(name) != expected {
+			t.Errorf("match of %s is not %v", name, expected)
+		}
+	}
+	if re, _ := globsToRegexp(nil); re != nil {
+		t.Fatal("expected no regexp without globs")
+	}
+}
+
+func TestTailForwardTagsFrames(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := &tailHub{subscribers: make(map[*tailSubscriber]struct{})}
+	s := h.subscribe(func(v InputLogPayload) bool { return v.Tag == "web" })
+	send := make(chan []byte, 1)
+	go s.forward(ctx, "sub-1", send)
+	h.publish([]InputLogPayload{{Tag: "web", Message: "a"}, {Tag: "billing", Message: "b"}})
+
+	var frame WSData
+	select {
+	case b := <-send:
+		if err := json.Unmarshal(b, &frame); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("tail batch is not forwarded")
+	}
+	if frame.Topic != TopicTail || frame.Id != "sub-1" {
+		t.Fatalf("expected tail frame of subscription sub-1, got %s %s", frame.Topic, frame.Id)
+	}
+	var msg OutputTailMessage
+	if err := json.Unmarshal([]byte(frame.Data), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Code != http.StatusOK || len(msg.Data) != 1 || msg.Data[0].Message != "a" {
+		t.Fatalf("unexpected tail batch %+v", msg)
+	}
+}
+
+func TestHasToken(t *testing.T) {
+	for s, expected := range map[string]bool{
+		"user":           true,
+		"user_id=1":      true,
+		"id_user":        true,
+		"a user.":        true,
+		"users":          false,
+		"superuser":      false,
+		"useruser user":  true,
+		"useré x":        false,
+		"éuser x":        false,
+		"no match here!": false,
+	} {
+		if hasToken(s, "user") != expected {
+			t.Errorf("token user in %q is not %v", s, expected)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package wal
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+/**
+Cursor reads the log on behalf of one consumer. Next hands out records in
+order and Commit persists how far the consumer has got. Segments are only
+removed once every cursor has committed past them.
+*/
+type Cursor struct {
+	log       *Log
+	name      string
+	pos       Position
+	committed Position
+	file      *os.File
+	fileId    uint64
+}
+
+func (l *Log) Cursor(name string) (*Cursor, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, ErrClosed
+	}
+	if c, ok := l.cursors[name]; ok {
+		return c, nil
+	}
+
+	c := &Cursor{
+		log:  l,
+		name: name,
+	}
+	data, err := ioutil.ReadFile(c.path())
+	switch {
+	case err == nil:
+		_, err = fmt.Sscanf(string(data), "%d %d", &c.committed.Segment, &c.committed.Offset)
+		if err != nil {
+			return nil, fmt.Errorf("read wal cursor %s get error %v", name, err)
+		}
+	case os.IsNotExist(err):
+		c.committed = Position{Segment: l.segments[0].id}
+	default:
+		return nil, err
+	}
+	c.pos = c.committed
+	l.cursors[name] = c
+	return c, nil
+}
+
+func (c *Cursor) path() string {
+	return filepath.Join(c.log.opts.Dir, cursorPrefix+c.name)
+}
+
+/**
+Next blocks until a record after the current position is available and
+returns it along with the position that must be committed once the record is
+processed.
+*/
+func (c *Cursor) Next(ctx context.Context) ([]byte, Position, error) {
+	l := c.log
+	for {
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			c.closeFile()
+			return nil, Position{}, ErrClosed
+		}
+
+		var s *segment
+		last := false
+		for i, v := range l.segments {
+			if v.id >= c.pos.Segment {
+				s = v
+				last = i == len(l.segments)-1
+				break
+			}
+		}
+		if s == nil || (last && s.id == c.pos.Segment && c.pos.Offset > s.size) {
+			/** the cursor is ahead of the log, its segments were removed */
+			s = l.activeSegment()
+			last = true
+			log.Printf("wal cursor %s is ahead of the log at segment %d, restart from segment %d\n",
+				c.name, c.pos.Segment, s.id)
+			c.pos = Position{Segment: s.id}
+			c.committed = c.pos
+		}
+		if s.id != c.pos.Segment {
+			log.Printf("wal cursor %s skips to segment %d since segment %d is dropped\n", c.name, s.id, c.pos.Segment)
+			c.pos = Position{Segment: s.id}
+		}
+
+		if c.pos.Offset >= s.size {
+			if !last {
+				c.pos = Position{Segment: s.id + 1}
+				l.mu.Unlock()
+				continue
+			}
+			notify := l.notify
+			l.mu.Unlock()
+			select {
+			case <-notify:
+			case <-ctx.Done():
+				return nil, Position{}, ctx.Err()
+			}
+			continue
+		}
+		l.mu.Unlock()
+
+		if c.file == nil || c.fileId != s.id {
+			c.closeFile()
+			f, err := os.Open(l.segmentPath(s.id))
+			if err != nil {
+				return nil, Position{}, err
+			}
+			c.file = f
+			c.fileId = s.id
+		}
+
+		data, n, err := readRecord(c.file, c.pos.Offset)
+		if err != nil {
+			log.Printf("wal cursor %s can not read segment %d at %d: %v. Skip the rest of segment\n",
+				c.name, s.id, c.pos.Offset, err)
+			c.pos = Position{Segment: s.id, Offset: s.size}
+			continue
+		}
+		c.pos = Position{Segment: s.id, Offset: c.pos.Offset + n}
+		return data, c.pos, nil
+	}
+}
+
+/**
+Commit persists pos as the position the consumer resumes from after a restart.
+*/
+func (c *Cursor) Commit(pos Position) error {
+	tmp := c.path() + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d %d", pos.Segment, pos.Offset)), 0644)
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, c.path()); err != nil {
+		return err
+	}
+
+	l := c.log
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c.committed = pos
+	l.enforceLimits()
+	return nil
+}
+
+func (c *Cursor) closeFile() {
+	if c.file != nil {
+		_ = c.file.Close()
+		c.file = nil
+	}
+}
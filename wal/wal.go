@@ -0,0 +1,321 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+Write-ahead log of accepted batches.
+
+The log is a directory of segment files named after their sequence number.
+Every record is framed as
+
+┌─length (4 bytes)─┬─crc32 (4 bytes)─┬─payload──────────┐
+│ big endian       │ IEEE of payload │ length bytes     │
+└──────────────────┴─────────────────┴──────────────────┘
+
+Records are only appended to the last (active) segment. Every consumer reads
+the log through its own named Cursor whose position is persisted next to the
+segments, so a restart resumes where each consumer stopped.
+*/
+
+const (
+	segmentExt   = ".wal"
+	cursorPrefix = "cursor-"
+	headerSize   = 8
+
+	DefaultSegmentSize int64 = 64 * 1024 * 1024
+)
+
+var (
+	ErrClosed       = errors.New("write-ahead log is closed")
+	errCorrupted    = errors.New("corrupted record in write-ahead log")
+	errRecordTooBig = errors.New("record is too big for write-ahead log")
+)
+
+type Options struct {
+	Dir string
+	// SegmentSize is the size in bytes after which the active segment is rotated
+	SegmentSize int64
+	// MaxSize limits the total size in bytes of all segments. Zero means no limit
+	MaxSize int64
+	// MaxAge limits how long a segment is kept. Zero means no limit
+	MaxAge time.Duration
+	// NoSync skips fsync after every append
+	NoSync bool
+}
+
+type Position struct {
+	Segment uint64
+	Offset  int64
+}
+
+type segment struct {
+	id       uint64
+	size     int64
+	modified time.Time
+}
+
+type Log struct {
+	mu       sync.Mutex
+	opts     Options
+	segments []*segment
+	active   *os.File
+	notify   chan struct{}
+	cursors  map[string]*Cursor
+	closed   bool
+	done     chan struct{}
+}
+
+func Open(opts Options) (*Log, error) {
+	if opts.Dir == "" {
+		return nil, errors.New("missing directory of write-ahead log")
+	}
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("create directory of write-ahead log get error %v", err)
+	}
+
+	l := &Log{
+		opts:    opts,
+		notify:  make(chan struct{}),
+		cursors: make(map[string]*Cursor),
+		done:    make(chan struct{}),
+	}
+
+	files, err := ioutil.ReadDir(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), segmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		l.segments = append(l.segments, &segment{id: id, size: f.Size(), modified: f.ModTime()})
+	}
+	sort.Slice(l.segments, func(i, j int) bool {
+		return l.segments[i].id < l.segments[j].id
+	})
+
+	nextId := uint64(1)
+	if len(l.segments) > 0 {
+		last := l.segments[len(l.segments)-1]
+		if err := l.recover(last); err != nil {
+			return nil, err
+		}
+		nextId = last.id + 1
+	}
+	if err := l.createSegment(nextId); err != nil {
+		return nil, err
+	}
+
+	go l.scheduleToEnforceLimits()
+	return l, nil
+}
+
+func (l *Log) segmentPath(id uint64) string {
+	return filepath.Join(l.opts.Dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+/**
+recover cuts a record that was only partially written before a crash off the
+tail of the segment.
+*/
+func (l *Log) recover(s *segment) error {
+	f, err := os.OpenFile(l.segmentPath(s.id), os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	offset := int64(0)
+	for offset < s.size {
+		_, n, err := readRecord(f, offset)
+		if err != nil {
+			break
+		}
+		offset += n
+	}
+	if offset < s.size {
+		log.Printf("truncate torn tail of wal segment %d from %d to %d bytes\n", s.id, s.size, offset)
+		if err := f.Truncate(offset); err != nil {
+			return err
+		}
+		s.size = offset
+	}
+	return nil
+}
+
+func (l *Log) createSegment(id uint64) error {
+	f, err := os.OpenFile(l.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("create wal segment get error %v", err)
+	}
+	if l.active != nil {
+		_ = l.active.Close()
+	}
+	l.active = f
+	l.segments = append(l.segments, &segment{id: id, modified: time.Now()})
+	return nil
+}
+
+func (l *Log) activeSegment() *segment {
+	return l.segments[len(l.segments)-1]
+}
+
+/**
+Append writes data as a new record and returns once it is synced to disk.
+*/
+func (l *Log) Append(data []byte) (Position, error) {
+	if int64(len(data)) > int64(^uint32(0)) {
+		return Position{}, errRecordTooBig
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return Position{}, ErrClosed
+	}
+
+	s := l.activeSegment()
+	if s.size > 0 && s.size+headerSize+int64(len(data)) > l.opts.SegmentSize {
+		if err := l.createSegment(s.id + 1); err != nil {
+			return Position{}, err
+		}
+		s = l.activeSegment()
+	}
+
+	buf := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(data))
+	copy(buf[headerSize:], data)
+
+	pos := Position{Segment: s.id, Offset: s.size}
+	if _, err := l.active.Write(buf); err != nil {
+		_ = l.active.Truncate(s.size)
+		return Position{}, fmt.Errorf("append to wal get error %v", err)
+	}
+	if !l.opts.NoSync {
+		if err := l.active.Sync(); err != nil {
+			_ = l.active.Truncate(s.size)
+			return Position{}, fmt.Errorf("sync wal get error %v", err)
+		}
+	}
+	s.size += int64(len(buf))
+	s.modified = time.Now()
+
+	close(l.notify)
+	l.notify = make(chan struct{})
+
+	l.enforceLimits()
+	return pos, nil
+}
+
+func (l *Log) scheduleToEnforceLimits() {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			l.mu.Lock()
+			l.enforceLimits()
+			l.mu.Unlock()
+		case <-l.done:
+			return
+		}
+	}
+}
+
+/**
+enforceLimits removes segments that every cursor has consumed, then segments
+that break the size or age limits even if they are not replayed yet.
+It must be called with the lock held.
+*/
+func (l *Log) enforceLimits() {
+	if l.closed {
+		return
+	}
+	var minSegment uint64
+	first := true
+	for _, c := range l.cursors {
+		if first || c.committed.Segment < minSegment {
+			minSegment = c.committed.Segment
+			first = false
+		}
+	}
+
+	total := int64(0)
+	for _, s := range l.segments {
+		total += s.size
+	}
+
+	now := time.Now()
+	for len(l.segments) > 1 {
+		s := l.segments[0]
+		consumed := !first && s.id < minSegment
+		tooBig := l.opts.MaxSize > 0 && total > l.opts.MaxSize
+		tooOld := l.opts.MaxAge > 0 && now.Sub(s.modified) > l.opts.MaxAge
+		if !consumed && !tooBig && !tooOld {
+			break
+		}
+		if !consumed {
+			log.Printf("drop wal segment %d before it is replayed to every driver (size %d bytes, modified %v)\n",
+				s.id, s.size, s.modified)
+		}
+		if err := os.Remove(l.segmentPath(s.id)); err != nil && !os.IsNotExist(err) {
+			log.Printf("remove wal segment %d get error %v\n", s.id, err)
+			break
+		}
+		total -= s.size
+		l.segments = l.segments[1:]
+	}
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+	close(l.notify)
+	return l.active.Close()
+}
+
+func readRecord(f *os.File, offset int64) ([]byte, int64, error) {
+	header := make([]byte, headerSize)
+	if _, err := f.ReadAt(header, offset); err != nil {
+		return nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+	data := make([]byte, length)
+	if _, err := f.ReadAt(data, offset+headerSize); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(data) != sum {
+		return nil, 0, errCorrupted
+	}
+	return data, headerSize + int64(length), nil
+}
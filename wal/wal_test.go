@@ -0,0 +1,157 @@
+package wal
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestLog(t *testing.T, dir string, opts Options) *Log {
+	t.Helper()
+	opts.Dir = dir
+	opts.NoSync = true
+	l, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func appendRecords(t *testing.T, l *Log, from int, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if _, err := l.Append([]byte(fmt.Sprintf("record-%02d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func nextRecord(t *testing.T, c *Cursor) (string, Position) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	data, pos, err := c.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data), pos
+}
+
+func TestCursorReadsAcrossSegments(t *testing.T) {
+	l := openTestLog(t, t.TempDir(), Options{SegmentSize: 40})
+	defer l.Close()
+
+	c, err := l.Cursor("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, l, 0, 10)
+	if len(l.segments) < 3 {
+		t.Fatalf("expected records spread over segments, got %d segments", len(l.segments))
+	}
+	for i := 0; i < 10; i++ {
+		if data, _ := nextRecord(t, c); data != fmt.Sprintf("record-%02d", i) {
+			t.Fatalf("record %d is %s", i, data)
+		}
+	}
+}
+
+func TestCursorResumesFromCommit(t *testing.T) {
+	dir := t.TempDir()
+	l := openTestLog(t, dir, Options{SegmentSize: 40})
+	c, err := l.Cursor("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, l, 0, 5)
+	var pos Position
+	for i := 0; i < 3; i++ {
+		_, pos = nextRecord(t, c)
+	}
+	if err := c.Commit(pos); err != nil {
+		t.Fatal(err)
+	}
+	_ = l.Close()
+
+	l = openTestLog(t, dir, Options{SegmentSize: 40})
+	defer l.Close()
+	c, err = l.Cursor("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := nextRecord(t, c); data != "record-03" {
+		t.Fatalf("expected to resume at record-03, got %s", data)
+	}
+}
+
+func TestCursorSkipsDroppedSegments(t *testing.T) {
+	l := openTestLog(t, t.TempDir(), Options{SegmentSize: 40, MaxSize: 60})
+	defer l.Close()
+
+	c, err := l.Cursor("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, l, 0, 10)
+	first := l.segments[0].id
+	if first == 1 {
+		t.Fatal("expected the oldest segments to be dropped")
+	}
+
+	data, pos := nextRecord(t, c)
+	if pos.Segment != first {
+		t.Fatalf("expected cursor to skip to segment %d, got %d", first, pos.Segment)
+	}
+	if data != "record-08" {
+		t.Fatalf("expected first record of segment %d, got %s", first, data)
+	}
+}
+
+func TestCursorAheadOfLog(t *testing.T) {
+	for _, committed := range []string{"99 0", "1 1000"} {
+		t.Run(committed, func(t *testing.T) {
+			dir := t.TempDir()
+			err := ioutil.WriteFile(filepath.Join(dir, cursorPrefix+"main"), []byte(committed), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l := openTestLog(t, dir, Options{})
+			defer l.Close()
+
+			c, err := l.Cursor("main")
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendRecords(t, l, 0, 1)
+			data, pos := nextRecord(t, c)
+			if data != "record-00" || pos.Segment != 1 {
+				t.Fatalf("expected record-00 of segment 1, got %s at %+v", data, pos)
+			}
+			if c.committed.Segment != 1 {
+				t.Fatalf("expected committed position to follow the reset, got %+v", c.committed)
+			}
+		})
+	}
+}
+
+func TestCursorStopsWhenClosed(t *testing.T) {
+	l := openTestLog(t, t.TempDir(), Options{})
+	c, err := l.Cursor("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_ = l.Close()
+	}()
+	if _, _, err := c.Next(context.Background()); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	if _, err := os.Stat(l.opts.Dir); err != nil {
+		t.Fatal(err)
+	}
+}
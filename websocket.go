@@ -8,33 +8,98 @@ import (
 	"hermes/core"
 	"log"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+/**
+Frames larger than this are sent with permessage-deflate when the client
+negotiated it.
+*/
+const compressionThreshold = 1024
+
 type WsConnection struct {
-	ws   *websocket.Conn
-	send chan []byte
+	ws         *websocket.Conn
+	send       chan []byte
+	tail       *tailSubscriber
+	stopTailFn context.CancelFunc
+	mu         sync.Mutex
+	queries    map[string]*wsQuery
 }
 
-type WSData struct {
-	Topic string `json:"topic"`
-	Data  string `json:"data"`
+/**
+A query with flow control only sends a batch of logs when it holds a credit,
+the client grants more with the credit topic.
+*/
+type wsQuery struct {
+	cancel      context.CancelFunc
+	flowControl bool
+	credits     int64
+	granted     chan struct{}
 }
 
-type LogQuery struct {
-	Tag        string `json:"tag"`
-	LogLevel   int32  `json:"level"`
-	TimeOption `json:"time"`
+type CreditData struct {
+	Batches int64 `json:"batches"`
+}
+
+func (q *wsQuery) grant(n int64) {
+	atomic.AddInt64(&q.credits, n)
+	select {
+	case q.granted <- struct{}{}:
+	default:
+	}
+}
+
+/**
+acquire takes one credit, waiting for the client to grant some if needed.
+*/
+func (q *wsQuery) acquire(ctx context.Context) bool {
+	if !q.flowControl {
+		return true
+	}
+	for {
+		if n := atomic.LoadInt64(&q.credits); n > 0 {
+			if atomic.CompareAndSwapInt64(&q.credits, n, n-1) {
+				return true
+			}
+			continue
+		}
+		select {
+		case <-q.granted:
+		case <-ctx.Done():
+			return false
+		}
+	}
 }
 
-type TimeOption struct {
-	Start int64 `json:"start"`
-	End   int64 `json:"end"`
+/**
+Id is chosen by the client to tell its queries apart. Every frame sent for a
+query (logs, done or error) carries the id of the query, the frames of a tail
+carry the id of its subscription.
+*/
+type WSData struct {
+	Topic string `json:"topic"`
+	Id    string `json:"id,omitempty"`
+	Data  string `json:"data"`
 }
 
 const (
-	TopicPing  = "ping"
-	TopicQuery = "query"
+	TopicPing      = "ping"
+	TopicQuery     = "query"
+	TopicCancel    = "cancel"
+	TopicCredit    = "credit"
+	TopicHistogram = "histogram"
+	TopicStats     = "stats"
+	TopicTail      = "tail"
+	TopicUntail    = "untail"
+
+	TopicLogs  = "logs"
+	TopicDone  = "done"
+	TopicError = "error"
+
+	/** nginx's code for a request closed by the client */
+	statusClientClosedRequest = 499
 )
 
 func (c *WsConnection) read(ctx context.Context) {
@@ -74,63 +139,265 @@ func (c *WsConnection) read(ctx context.Context) {
 			err = json.Unmarshal([]byte(wsData.Data), &query)
 			if err != nil {
 				log.Printf("Can not unmarshal query from client %s\n", c.ws.RemoteAddr())
+				c.sendFrame(ctx, TopicError, wsData.Id, core.OutputMessage{
+					Code:    http.StatusBadRequest,
+					Message: err.Error(),
+				})
 				break
 			}
-			if core.StrIsEmpty(query.Tag) {
-				log.Println("missing tag in query option")
+			c.startQuery(ctx, wsData.Id, query)
+			break
+		case TopicHistogram:
+			var query HistogramQuery
+			err = json.Unmarshal([]byte(wsData.Data), &query)
+			if err != nil {
+				log.Printf("Can not unmarshal histogram query from client %s\n", c.ws.RemoteAddr())
+				c.sendFrame(ctx, TopicError, wsData.Id, core.OutputMessage{
+					Code:    http.StatusBadRequest,
+					Message: err.Error(),
+				})
 				break
 			}
-
-			response := make(chan core.OutputLogMessage)
-			go func(c context.Context, response chan core.OutputLogMessage, send chan []byte) {
-				exit := false
-				for !exit {
-					select {
-					case <-c.Done():
-						break
-					case msg := <-response:
-						if msg.Code != http.StatusOK {
-							close(response)
-							exit = true
-							break
-						}
-						bytes, err := json.Marshal(&msg)
-						if err != nil {
-							log.Printf("error %v while marshalling batch of message\n", err)
-							continue
-						}
-						wsData := WSData{
-							Topic: "logs",
-							Data:  string(bytes),
-						}
-						bytes, err = json.Marshal(wsData)
-						if err != nil {
-							log.Printf("error %v while marshalling batch of message\n", err)
-							continue
-						}
-						send <- bytes
-						break
-					}
-				}
-			}(ctx, response, c.send)
-
-			err := mainStorage.FetchingLog(ctx, core.QueryLogOption{
-				Tag:       query.Tag,
-				LogLevel:  query.LogLevel,
-				StartTime: query.Start,
-				EndTime:   query.End,
-				BatchSize: 1000,
-				Response:  response,
+			c.startAggregation(ctx, wsData.Id, TopicHistogram, func(ctx context.Context) interface{} {
+				return histogram(ctx, query)
 			})
+			break
+		case TopicStats:
+			var query StatsQuery
+			err = json.Unmarshal([]byte(wsData.Data), &query)
 			if err != nil {
-				log.Printf("Can not unmarshal query from client %s\n", c.ws.RemoteAddr())
-				return
+				log.Printf("Can not unmarshal stats query from client %s\n", c.ws.RemoteAddr())
+				c.sendFrame(ctx, TopicError, wsData.Id, core.OutputMessage{
+					Code:    http.StatusBadRequest,
+					Message: err.Error(),
+				})
+				break
+			}
+			c.startAggregation(ctx, wsData.Id, TopicStats, func(ctx context.Context) interface{} {
+				return stats(ctx, query)
+			})
+			break
+		case TopicCancel:
+			c.cancelQuery(wsData.Id)
+			break
+		case TopicCredit:
+			var credit CreditData
+			err = json.Unmarshal([]byte(wsData.Data), &credit)
+			if err != nil || credit.Batches <= 0 {
+				log.Printf("invalid credit from client %s\n", c.ws.RemoteAddr())
+				break
+			}
+			c.mu.Lock()
+			q, ok := c.queries[wsData.Id]
+			c.mu.Unlock()
+			if ok {
+				q.grant(credit.Batches)
+			}
+			break
+		case TopicTail:
+			var query LogQuery
+			err = json.Unmarshal([]byte(wsData.Data), &query)
+			if err == nil {
+				err = c.startTail(ctx, wsData.Id, query)
+			}
+			if err != nil {
+				log.Printf("invalid tail query from client %s. %v\n", c.ws.RemoteAddr(), err)
+				c.sendFrame(ctx, TopicTail, wsData.Id, core.OutputMessage{
+					Code:    http.StatusBadRequest,
+					Message: err.Error(),
+				})
+			}
+			break
+		case TopicUntail:
+			c.stopTail()
+			break
+		default:
+			break
+		}
+	}
+	c.stopTail()
+}
+
+/**
+sendFrame queues v as the data of a frame, giving up when ctx is done.
+*/
+func (c *WsConnection) sendFrame(ctx context.Context, topic string, id string, v interface{}) bool {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("error %v while marshalling frame of topic %s\n", err, topic)
+		return false
+	}
+	bytes, err = json.Marshal(WSData{
+		Topic: topic,
+		Id:    id,
+		Data:  string(bytes),
+	})
+	if err != nil {
+		log.Printf("error %v while marshalling frame of topic %s\n", err, topic)
+		return false
+	}
+	select {
+	case c.send <- bytes:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+/**
+startQuery runs the query in the background so that several queries can
+share the connection. A running query with the same id is cancelled first.
+*/
+func (c *WsConnection) startQuery(ctx context.Context, id string, query LogQuery) {
+	response := make(chan core.OutputLogMessage)
+	opt, err := query.option(1000, response)
+	if err != nil {
+		log.Printf("invalid query from client %s. %v\n", c.ws.RemoteAddr(), err)
+		c.sendFrame(ctx, TopicError, id, core.OutputMessage{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	queryCtx, cancel := context.WithCancel(ctx)
+	q := &wsQuery{
+		cancel:      cancel,
+		flowControl: query.Credits > 0,
+		credits:     query.Credits,
+		granted:     make(chan struct{}, 1),
+	}
+	c.mu.Lock()
+	if previous, ok := c.queries[id]; ok {
+		previous.cancel()
+	}
+	c.queries[id] = q
+	c.mu.Unlock()
+
+	go fetchLog(queryCtx, opt)
+	go c.forwardQuery(ctx, queryCtx, id, q, response)
+}
+
+/**
+startAggregation runs an aggregation in the background and answers with a
+frame of topic. It can be cancelled like a query.
+*/
+func (c *WsConnection) startAggregation(ctx context.Context, id string, topic string,
+	run func(ctx context.Context) interface{}) {
+	queryCtx, cancel := context.WithCancel(ctx)
+	q := &wsQuery{cancel: cancel}
+	c.mu.Lock()
+	if previous, ok := c.queries[id]; ok {
+		previous.cancel()
+	}
+	c.queries[id] = q
+	c.mu.Unlock()
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			if c.queries[id] == q {
+				delete(c.queries, id)
+			}
+			c.mu.Unlock()
+			cancel()
+		}()
+		response := run(queryCtx)
+		if queryCtx.Err() != nil {
+			c.sendFrame(ctx, TopicDone, id, core.OutputMessage{
+				Code:    statusClientClosedRequest,
+				Message: "cancelled",
+			})
+			return
+		}
+		c.sendFrame(ctx, topic, id, response)
+	}()
+}
+
+func (c *WsConnection) cancelQuery(id string) {
+	c.mu.Lock()
+	q, ok := c.queries[id]
+	c.mu.Unlock()
+	if ok {
+		q.cancel()
+	}
+}
+
+/**
+forwardQuery sends the batches of the query to the client. It reads the
+response channel up to its last message even after the query is cancelled,
+otherwise the driver would block on it and keep its connection.
+*/
+func (c *WsConnection) forwardQuery(ctx context.Context, queryCtx context.Context, id string,
+	q *wsQuery, response chan core.OutputLogMessage) {
+	defer func() {
+		c.mu.Lock()
+		if c.queries[id] == q {
+			delete(c.queries, id)
+		}
+		c.mu.Unlock()
+		q.cancel()
+	}()
+
+	for msg := range response {
+		final := msg.Code != http.StatusOK
+		switch {
+		case queryCtx.Err() != nil:
+			break
+		case msg.Code == http.StatusOK:
+			if q.acquire(queryCtx) {
+				c.sendFrame(queryCtx, TopicLogs, id, msg)
 			}
 			break
+		case msg.Code == http.StatusNoContent:
+			c.sendFrame(queryCtx, TopicDone, id, msg)
+			break
 		default:
+			c.sendFrame(queryCtx, TopicError, id, msg.OutputMessage)
+			break
+		}
+		if final {
 			break
 		}
 	}
+
+	if queryCtx.Err() != nil && ctx.Err() == nil {
+		c.sendFrame(ctx, TopicDone, id, core.OutputMessage{
+			Code:    statusClientClosedRequest,
+			Message: "cancelled",
+		})
+	}
+}
+
+/**
+startTail subscribes the connection to the logs matching query, replacing the
+previous tail if any.
+*/
+func (c *WsConnection) startTail(ctx context.Context, id string, query LogQuery) error {
+	opt, err := query.option(0, nil)
+	if err != nil {
+		return err
+	}
+	match, err := matchLog(opt)
+	if err != nil {
+		return err
+	}
+	c.stopTail()
+	tailCtx, cancel := context.WithCancel(ctx)
+	c.tail = tails.subscribe(match)
+	c.stopTailFn = cancel
+	go c.tail.forward(tailCtx, id, c.send)
+	return nil
+}
+
+func (c *WsConnection) stopTail() {
+	if c.tail == nil {
+		return
+	}
+	tails.unsubscribe(c.tail)
+	c.stopTailFn()
+	c.tail = nil
+	c.stopTailFn = nil
 }
 
 func (c *WsConnection) write(ctx context.Context) {
@@ -138,6 +405,7 @@ func (c *WsConnection) write(ctx context.Context) {
 	for !exit {
 		select {
 		case bytes := <-c.send:
+			c.ws.EnableWriteCompression(len(bytes) > compressionThreshold)
 			_ = c.ws.WriteMessage(websocket.TextMessage, bytes)
 			break
 		case <-ctx.Done():
@@ -150,14 +418,18 @@ func (c *WsConnection) write(ctx context.Context) {
 	log.Println("close connection")
 }
 
+/**
+close leaves send open since goroutines of queries and tails may still be
+writing to it, they stop with the context of the connection.
+*/
 func (c *WsConnection) close() {
 	_ = c.ws.Close()
-	close(c.send)
 }
 
 var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+	ReadBufferSize:    1024,
+	WriteBufferSize:   1024,
+	EnableCompression: true,
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
@@ -171,8 +443,9 @@ func webSocket(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	}
 	log.Printf("accept connection from %v\n", conn.RemoteAddr())
 	wsc := &WsConnection{
-		ws:   conn,
-		send: make(chan []byte, 256),
+		ws:      conn,
+		send:    make(chan []byte, 256),
+		queries: make(map[string]*wsQuery),
 	}
 	ctx, cancel := context.WithCancel(r.Context())
 	defer func() {